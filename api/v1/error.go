@@ -3,6 +3,7 @@ package log_v1
 import (
 	"fmt"
 	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
@@ -30,3 +31,40 @@ func (errO ErrOffsetOutOfRange) Error() string {
 type ErrOffsetOutOfRange struct {
 	Offset uint64
 }
+
+func (errC ErrCorruptRecord) GRPCStatus() *status.Status {
+	st := status.New(codes.DataLoss, fmt.Sprintf(
+		"corrupt record at offset %d: segment %d, position %d",
+		errC.Offset,
+		errC.BaseOffset,
+		errC.Position,
+	))
+	msg := fmt.Sprintf(
+		"The record stored at offset %d failed its integrity check and cannot be read",
+		errC.Offset,
+	)
+
+	errDtls := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+
+	details, err := st.WithDetails(errDtls)
+	if err != nil {
+		return st
+	}
+
+	return details
+}
+
+func (errC ErrCorruptRecord) Error() string {
+	return errC.GRPCStatus().Err().Error()
+}
+
+// ErrCorruptRecord is returned when a stored record fails its checksum.
+// BaseOffset identifies the segment and Position the record's frame in its store file.
+type ErrCorruptRecord struct {
+	Offset     uint64
+	BaseOffset uint64
+	Position   uint64
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/xhantimda/commitlog/internal/log"
+	"os"
+)
+
+const usage = `usage: logtool <command> [flags]
+
+commands:
+  rebuild-index   regenerate segment indexes from their store files
+  migrate         upgrade segments written in older store formats
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "rebuild-index":
+		err = rebuildIndex(os.Args[2:])
+	case "migrate":
+		err = migrate(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// rebuildIndex opens the log in the given directory and rebuilds the index
+// of one segment, or of all of them when no base offset is given.
+func rebuildIndex(args []string) error {
+	flags := flag.NewFlagSet("rebuild-index", flag.ExitOnError)
+	dir := flags.String("dir", "", "log directory")
+	base := flags.Int64("base", -1, "base offset of the segment to rebuild, all segments if negative")
+	config := configFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return fmt.Errorf("rebuild-index: -dir is required")
+	}
+
+	conf, err := config()
+	if err != nil {
+		return err
+	}
+
+	commitLog, err := log.NewLog(*dir, conf)
+	if err != nil {
+		return err
+	}
+
+	var reports []log.SegmentRecovery
+	if *base < 0 {
+		reports, err = commitLog.RebuildIndexes()
+	} else {
+		var report log.SegmentRecovery
+		report, err = commitLog.RebuildIndex(uint64(*base))
+		reports = append(reports, report)
+	}
+
+	for _, report := range reports {
+		fmt.Printf(
+			"segment %d: indexed %d records, truncated %d bytes\n",
+			report.BaseOffset,
+			report.IndexedRecords,
+			report.TruncatedBytes,
+		)
+	}
+
+	if closeErr := commitLog.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// migrate opens the log in the given directory and upgrades its sealed
+// segments to the current store format. It can be run again after it's
+// interrupted, and picks up where it stopped.
+func migrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dir := flags.String("dir", "", "log directory")
+	config := configFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return fmt.Errorf("migrate: -dir is required")
+	}
+
+	conf, err := config()
+	if err != nil {
+		return err
+	}
+
+	commitLog, err := log.NewLog(*dir, conf)
+	if err != nil {
+		return err
+	}
+
+	migrations, err := commitLog.Migrate()
+	for _, migration := range migrations {
+		fmt.Printf(
+			"segment %d: rewrote %d records from version %d to %d, %d bytes to %d\n",
+			migration.BaseOffset,
+			migration.Records,
+			migration.From,
+			migration.To,
+			migration.BytesBefore,
+			migration.BytesAfter,
+		)
+	}
+	if err == nil && len(migrations) == 0 {
+		fmt.Println("nothing to migrate")
+	}
+
+	if closeErr := commitLog.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// codecs are the codecs -compression takes, by name.
+var codecs = map[string]log.Codec{
+	"gzip":  log.Gzip,
+	"flate": log.Flate,
+	"zlib":  log.Zlib,
+}
+
+// configFlags registers the settings the log was written with: an active
+// segment keeps being appended to with its sizes and index intervals, and
+// records are compressed and encrypted as they were. The returned function
+// builds the config once the flags are parsed.
+func configFlags(flags *flag.FlagSet) func() (log.Config, error) {
+	conf := log.Config{}
+	flags.Uint64Var(&conf.Segment.MaxStoreBytes, "max-store-bytes", 1<<30, "maximum store size per segment")
+	flags.Uint64Var(&conf.Segment.MaxIndexBytes, "max-index-bytes", 10<<20, "maximum index size per segment")
+	flags.Uint64Var(&conf.Segment.IndexIntervalRecords, "index-interval-records", 0, "records between sparse index entries, 0 for none")
+	flags.Uint64Var(&conf.Segment.IndexIntervalBytes, "index-interval-bytes", 0, "store bytes between sparse index entries, 0 for none")
+	compression := flags.String("compression", "", "codec new records are compressed with: gzip, flate or zlib")
+	keyDir := flags.String("key-dir", "", "directory of the encryption keys, records aren't encrypted without one")
+
+	return func() (log.Config, error) {
+		if *compression != "" {
+			codec, ok := codecs[*compression]
+			if !ok {
+				return conf, fmt.Errorf("unknown codec %q", *compression)
+			}
+			conf.Compression = codec
+		}
+		if *keyDir != "" {
+			keys, err := log.NewFileKeyProvider(*keyDir)
+			if err != nil {
+				return conf, err
+			}
+			conf.Encryption = keys
+		}
+		return conf, nil
+	}
+}
@@ -0,0 +1,188 @@
+package log
+
+import (
+	"os"
+	"time"
+)
+
+// CleanerEvent describes a change the cleaner made to the log, or an error
+// that stopped it.
+type CleanerEvent struct {
+	Kind       CleanerEventKind
+	BaseOffset uint64
+	// Records and Bytes count what the change removed from the log; for a
+	// segment removed by retention, Records counts the offsets it held.
+	Records uint64
+	Bytes   uint64
+	Err     error
+}
+
+type CleanerEventKind int
+
+const (
+	// SegmentCompacted is a sealed segment rewritten without the records
+	// compaction removed.
+	SegmentCompacted CleanerEventKind = iota
+	// SegmentRemoved is a sealed segment removed because compaction left
+	// it without records.
+	SegmentRemoved
+	// CleanerFailed is a cleaner run that stopped with Err. The next run
+	// tries again.
+	CleanerFailed
+	// SegmentExpired is a sealed segment removed because its newest record
+	// was older than Retention.MaxAge.
+	SegmentExpired
+	// SegmentEvicted is a sealed segment removed because the log took up
+	// more than Retention.MaxBytes.
+	SegmentEvicted
+	// SegmentConsumed is a sealed segment removed because every registered
+	// consumer had committed past it.
+	SegmentConsumed
+	// SegmentCapped is a sealed segment removed because the log took up
+	// more than Retention.HardMaxBytes, whether it had been consumed or not.
+	SegmentCapped
+	// SegmentOffloaded is a sealed segment uploaded to Tiering.Store and
+	// removed from local disk; it's still read from the blob store.
+	SegmentOffloaded
+)
+
+// startCleaner runs the cleaner every Cleaner.Interval in the background.
+func (log *Log) startCleaner() {
+	retention := log.Config.Retention.MaxAge > 0 || log.Config.Retention.MaxBytes > 0 ||
+		log.Config.Retention.ConsumerGated || log.Config.Retention.HardMaxBytes > 0
+	tiering := log.Config.Tiering.Store != nil
+	if log.Config.Cleaner.Interval <= 0 || !(retention || tiering || log.Config.Compaction.Enabled) {
+		return
+	}
+
+	done := log.done
+	log.background.Add(1)
+
+	go func() {
+		defer log.background.Done()
+
+		ticker := time.NewTicker(log.Config.Cleaner.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				log.clean(done)
+			}
+		}
+	}()
+}
+
+// clean offloads old segments, enforces retention and then, if it's
+// enabled, compacts the log.
+func (log *Log) clean(stop <-chan struct{}) {
+	if err := log.Offload(); err != nil {
+		log.emit(CleanerEvent{Kind: CleanerFailed, Err: err})
+		return
+	}
+	if err := log.EnforceRetention(); err != nil {
+		log.emit(CleanerEvent{Kind: CleanerFailed, Err: err})
+		return
+	}
+	if !log.Config.Compaction.Enabled {
+		return
+	}
+	if err := log.compact(stop); err != nil {
+		log.emit(CleanerEvent{Kind: CleanerFailed, Err: err})
+	}
+}
+
+// EnforceRetention removes the oldest sealed segments while they're older
+// than Retention.MaxAge or the log takes up more than Retention.MaxBytes,
+// as long as they've been consumed when Retention.ConsumerGated is set, and
+// while the log takes up more than Retention.HardMaxBytes regardless.
+// Segments are only removed from the start of the log, so it never has
+// holes, and the active segment is always kept.
+func (log *Log) EnforceRetention() error {
+	if err := log.writable(); err != nil {
+		return err
+	}
+
+	events, err := log.enforceRetention()
+	for _, event := range events {
+		log.emit(event)
+	}
+	return err
+}
+
+func (log *Log) enforceRetention() ([]CleanerEvent, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	retention := log.Config.Retention
+	deadline := time.Now().Add(-retention.MaxAge)
+
+	var size uint64
+	for _, segment := range log.segments {
+		size += segment.store.size
+	}
+
+	var events []CleanerEvent
+	for len(log.segments) > 1 {
+		oldest := log.segments[0]
+
+		event := CleanerEvent{
+			BaseOffset: oldest.baseOffset,
+			Records:    oldest.nextOffset - oldest.baseOffset,
+			Bytes:      oldest.store.size,
+		}
+
+		modified, err := oldest.lastModified()
+		if err != nil {
+			return events, err
+		}
+
+		switch {
+		case retention.HardMaxBytes > 0 && size > retention.HardMaxBytes:
+			event.Kind = SegmentCapped
+		case retention.ConsumerGated && !log.consumed(oldest):
+			return events, nil
+		case retention.MaxAge > 0 && modified.Before(deadline):
+			event.Kind = SegmentExpired
+		case retention.MaxBytes > 0 && size > retention.MaxBytes:
+			event.Kind = SegmentEvicted
+		case retention.ConsumerGated && retention.MaxAge == 0 && retention.MaxBytes == 0:
+			event.Kind = SegmentConsumed
+		default:
+			return events, nil
+		}
+
+		log.segments = log.segments[1:]
+		if err = log.removeSegments(oldest); err != nil {
+			return events, err
+		}
+		size -= event.Bytes
+
+		log.removedSegments++
+		log.removedBytes += event.Bytes
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// lastModified returns when the segment's newest record was appended, or
+// when its store was last written if its records aren't stamped.
+func (seg *segment) lastModified() (time.Time, error) {
+	if seg.lastTimestamp > 0 {
+		return time.UnixMilli(seg.lastTimestamp), nil
+	}
+	info, err := os.Stat(seg.store.Name())
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// emit passes the event to Cleaner.OnEvent, if it's set.
+func (log *Log) emit(event CleanerEvent) {
+	if log.Config.Cleaner.OnEvent != nil {
+		log.Config.Cleaner.OnEvent(event)
+	}
+}
@@ -0,0 +1,144 @@
+package log
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Codec compresses records before they're written to a store. The codec's
+// ID is written alongside each record, so a store can hold records encoded
+// by different codecs and a log's codec can change over time.
+type Codec interface {
+	// ID identifies the codec in store frames, from 1 to maxCodecID; 0 means
+	// the record isn't compressed.
+	ID() uint8
+	Encode(p []byte) ([]byte, error)
+	Decode(p []byte) ([]byte, error)
+}
+
+const (
+	// codecMask selects the codec ID from a frame's attributes.
+	codecMask  = 0x0f
+	maxCodecID = codecMask
+)
+
+var (
+	// Gzip, Flate and Zlib compress records with the standard library's
+	// implementations at their default compression level.
+	Gzip  Codec = gzipCodec{}
+	Flate Codec = flateCodec{}
+	Zlib  Codec = zlibCodec{}
+
+	codecsMutex sync.RWMutex
+	codecs      = map[uint8]Codec{
+		Gzip.ID():  Gzip,
+		Flate.ID(): Flate,
+		Zlib.ID():  Zlib,
+	}
+)
+
+// RegisterCodec makes a codec available to decode the records it encoded.
+// The built-in codecs are always registered. It panics if the codec's ID
+// is out of range or already taken.
+func RegisterCodec(codec Codec) {
+	codecsMutex.Lock()
+	defer codecsMutex.Unlock()
+
+	id := codec.ID()
+	if id == 0 || id > maxCodecID {
+		panic(fmt.Sprintf("log: codec ID %d out of range", id))
+	}
+	if _, ok := codecs[id]; ok {
+		panic(fmt.Sprintf("log: codec ID %d registered twice", id))
+	}
+	codecs[id] = codec
+}
+
+// codecByID returns the registered codec with the given ID.
+func codecByID(id uint8) (Codec, error) {
+	codecsMutex.RLock()
+	defer codecsMutex.RUnlock()
+
+	codec, ok := codecs[id]
+	if !ok {
+		return nil, ErrUnknownCodec{ID: id}
+	}
+	return codec, nil
+}
+
+type gzipCodec struct{}
+
+func (gzipCodec) ID() uint8 { return 1 }
+
+func (gzipCodec) Encode(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return encode(&buf, gzip.NewWriter(&buf), p)
+}
+
+func (gzipCodec) Decode(p []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	return decode(r)
+}
+
+type flateCodec struct{}
+
+func (flateCodec) ID() uint8 { return 2 }
+
+func (flateCodec) Encode(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	return encode(&buf, w, p)
+}
+
+func (flateCodec) Decode(p []byte) ([]byte, error) {
+	return decode(flate.NewReader(bytes.NewReader(p)))
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) ID() uint8 { return 3 }
+
+func (zlibCodec) Encode(p []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	return encode(&buf, zlib.NewWriter(&buf), p)
+}
+
+func (zlibCodec) Decode(p []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	return decode(r)
+}
+
+// encode writes p through the compressing writer w into buf.
+func encode(buf *bytes.Buffer, w io.WriteCloser, p []byte) ([]byte, error) {
+	if _, err := w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decode reads everything from the decompressing reader r.
+func decode(r io.ReadCloser) ([]byte, error) {
+	p, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return p, r.Close()
+}
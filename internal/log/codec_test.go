@@ -0,0 +1,30 @@
+package log
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestCodecs(t *testing.T) {
+	want := bytes.Repeat([]byte(`{"hello":"world"}`), 32)
+
+	for _, codec := range []Codec{Gzip, Flate, Zlib} {
+		encoded, err := codec.Encode(want)
+		require.NoError(t, err)
+		require.Less(t, len(encoded), len(want))
+
+		got, err := codec.Decode(encoded)
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+
+		registered, err := codecByID(codec.ID())
+		require.NoError(t, err)
+		require.Equal(t, codec, registered)
+	}
+
+	_, err := codecByID(maxCodecID)
+	require.Equal(t, ErrUnknownCodec{ID: maxCodecID}, err)
+
+	require.Panics(t, func() { RegisterCodec(Gzip) })
+}
@@ -0,0 +1,349 @@
+package log
+
+import (
+	"fmt"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// cleanedExt marks the files of a segment rewritten by compaction or
+// migration until they replace the segment's own.
+const cleanedExt = ".cleaned"
+
+// Compact rewrites the log's sealed segments so they only keep the latest
+// record for each key. Records without a key are always kept, and a
+// tombstone, a keyed record with an empty value, is kept as the latest
+// record for its key until Compaction.TombstoneRetention has passed since
+// it was appended. Records keep their offsets, so a compacted log has gaps
+// and Read returns the first record after an offset that was removed.
+// Segments left without records are removed. The active segment is never
+// compacted, so a key's records in sealed segments are kept until its
+// latest one is sealed too.
+func (log *Log) Compact() error {
+	if err := log.writable(); err != nil {
+		return err
+	}
+
+	return log.compact(nil)
+}
+
+// compact compacts the sealed segments one at a time, giving up between
+// them once stop is closed.
+func (log *Log) compact(stop <-chan struct{}) error {
+	log.compactMutex.Lock()
+	defer log.compactMutex.Unlock()
+
+	log.mutex.RLock()
+	sealed := append([]*segment(nil), log.segments[:len(log.segments)-1]...)
+	log.mutex.RUnlock()
+
+	latest := make(map[string]uint64)
+	for _, segment := range sealed {
+		err := log.scanSealed(segment, func(record *api.Record) error {
+			if len(record.Key) > 0 {
+				latest[string(record.Key)] = record.Offset
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	tombstoneDeadline := time.Now().Add(-log.Config.Compaction.TombstoneRetention).UnixMilli()
+	keep := func(record *api.Record) bool {
+		if len(record.Key) == 0 {
+			return true
+		}
+		if latest[string(record.Key)] != record.Offset {
+			return false
+		}
+		return len(record.Value) > 0 || record.Timestamp >= tombstoneDeadline
+	}
+
+	for _, segment := range sealed {
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+
+		event, err := log.compactSegment(segment, keep)
+		if err != nil {
+			return err
+		}
+		if event != nil {
+			log.emit(*event)
+		}
+	}
+	return nil
+}
+
+// scanSealed calls fn with each record in a sealed segment, unless the
+// segment was removed from the log since it was picked. Nothing is appended
+// to a sealed segment, so it's scanned without the log's lock; if it's
+// removed while it's scanned, its closed files fail the scan, which is
+// given up on.
+func (log *Log) scanSealed(segment *segment, fn func(record *api.Record) error) error {
+	if !log.hasSegment(segment) {
+		return nil
+	}
+	if err := segment.scan(fn); err != nil && log.hasSegment(segment) {
+		return err
+	}
+	return nil
+}
+
+// hasSegment reports whether the segment is still in the log.
+func (log *Log) hasSegment(segment *segment) bool {
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+
+	return log.segmentIndex(segment) >= 0
+}
+
+// compactSegment rewrites a sealed segment with only the records keep
+// returns true for and swaps it in for the original. It returns what it
+// did, or nil if nothing had to be removed. The rewrite is done without
+// the log's lock, which is only taken to swap the segments.
+func (log *Log) compactSegment(old *segment, keep func(record *api.Record) bool) (*CleanerEvent, error) {
+	if !log.hasSegment(old) {
+		return nil, nil
+	}
+
+	cleaned, err := newCleanedSegment(log.Dir, old, storeVersion|storeFlagCompacted, log.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept, removed uint64
+	err = old.scan(func(record *api.Record) error {
+		if !keep(record) {
+			removed++
+			return nil
+		}
+		kept++
+		return cleaned.write(record)
+	})
+	if err == nil {
+		err = cleaned.sync()
+	}
+	if closeErr := cleaned.Close(); err == nil {
+		err = closeErr
+	}
+
+	// a segment removed while it was rewritten fails the scan
+	if err != nil && !log.hasSegment(old) {
+		err = nil
+		removed = 0
+	}
+	if err != nil || removed == 0 {
+		if removeErr := removeCleaned(log.Dir, old.baseOffset); err == nil {
+			err = removeErr
+		}
+		return nil, err
+	}
+
+	event := &CleanerEvent{
+		Kind:       SegmentCompacted,
+		BaseOffset: old.baseOffset,
+		Records:    removed,
+		Bytes:      old.store.size - cleaned.store.size,
+	}
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	i := log.segmentIndex(old)
+	if i < 0 {
+		return nil, removeCleaned(log.Dir, old.baseOffset)
+	}
+
+	if kept == 0 {
+		if err = removeCleaned(log.Dir, old.baseOffset); err != nil {
+			return nil, err
+		}
+		log.segments = append(log.segments[:i], log.segments[i+1:]...)
+		if err = log.removeSegments(old); err != nil {
+			return nil, err
+		}
+		event.Kind = SegmentRemoved
+		return event, nil
+	}
+
+	return event, log.swapCleaned(i, old)
+}
+
+// swapCleaned swaps the rewritten files of the log's i-th segment in for
+// its own and reopens it. The caller must hold the write lock.
+func (log *Log) swapCleaned(i int, old *segment) error {
+	if err := old.Close(); err != nil {
+		return err
+	}
+	if err := installCleaned(log.Dir, old.baseOffset); err != nil {
+		return err
+	}
+
+	segment, err := newSegment(log.Dir, old.baseOffset, log.Config)
+	if err != nil {
+		return err
+	}
+	segment.nextOffset = old.nextOffset
+	if err = segment.store.seal(); err != nil {
+		return err
+	}
+	log.segments[i] = segment
+	return nil
+}
+
+// segmentIndex returns where the segment is in the log, or -1 if it isn't.
+// The caller must hold the lock.
+func (log *Log) segmentIndex(segment *segment) int {
+	for i, s := range log.segments {
+		if s == segment {
+			return i
+		}
+	}
+	return -1
+}
+
+// newCleanedSegment creates the files for a rewritten copy of the segment,
+// next to the segment's own, with a store that starts with the given
+// header: its format version and flags.
+func newCleanedSegment(dir string, old *segment, header uint32, conf Config) (*segment, error) {
+	baseOffset := old.baseOffset
+
+	// a record after every gap gets an index entry, so the index can need
+	// an entry for each record even when the segment's own is sparse
+	if records := (old.nextOffset - old.baseOffset) * entWidth; records > conf.Segment.MaxIndexBytes {
+		conf.Segment.MaxIndexBytes = records
+	}
+
+	seg := &segment{
+		baseOffset: baseOffset,
+		nextOffset: baseOffset,
+		config:     conf,
+	}
+
+	storeFile, err := os.OpenFile(
+		cleanedName(dir, baseOffset, ".store"),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeStoreHeader(storeFile, header); err != nil {
+		return nil, err
+	}
+	if seg.store, err = newStore(storeFile, conf); err != nil {
+		return nil, err
+	}
+
+	indexFile, err := os.OpenFile(
+		cleanedName(dir, baseOffset, ".index"),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if seg.index, err = newIndex(indexFile, conf); err != nil {
+		return nil, err
+	}
+
+	timeIndexFile, err := os.OpenFile(
+		cleanedName(dir, baseOffset, ".timeindex"),
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		0644,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if seg.timeIndex, err = newIndex(timeIndexFile, timeIndexConfig(conf)); err != nil {
+		return nil, err
+	}
+
+	return seg, nil
+}
+
+// installCleaned renames a compacted segment's files over the segment's
+// own. The store goes first: once it's in place the swap is committed,
+// and finishCompactions completes it if the process dies before the
+// indexes follow.
+func installCleaned(dir string, baseOffset uint64) error {
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		name := path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+		if err := os.Rename(name+cleanedExt, name); err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+// removeCleaned removes the files of a compacted segment that won't be swapped in.
+func removeCleaned(dir string, baseOffset uint64) error {
+	for _, ext := range []string{".store", ".index", ".timeindex"} {
+		err := os.Remove(cleanedName(dir, baseOffset, ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// finishCompactions deals with the rewritten segments a crash left behind,
+// compacted or migrated: a segment whose rewritten store is still there
+// hadn't been swapped, so its rewritten files are removed; otherwise the store was swapped and the
+// indexes are moved in after it.
+func finishCompactions(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	unswapped := make(map[string]bool)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".store"+cleanedExt) {
+			unswapped[strings.TrimSuffix(file.Name(), ".store"+cleanedExt)] = true
+		}
+	}
+
+	for _, file := range files {
+		name := strings.TrimSuffix(file.Name(), cleanedExt)
+		if name == file.Name() {
+			continue
+		}
+
+		if unswapped[strings.TrimSuffix(name, path.Ext(name))] {
+			err = os.Remove(path.Join(dir, file.Name()))
+		} else {
+			err = os.Rename(path.Join(dir, file.Name()), path.Join(dir, name))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return syncDir(dir)
+}
+
+func cleanedName(dir string, baseOffset uint64, ext string) string {
+	return path.Join(dir, fmt.Sprintf("%d%s%s", baseOffset, ext, cleanedExt))
+}
+
+// syncDir commits the renames and removals in a directory to stable storage.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
@@ -1,9 +1,117 @@
 package log
 
+import "time"
+
 type Config struct {
 	Segment struct {
 		MaxStoreBytes uint64
 		MaxIndexBytes uint64
 		InitialOffset uint64
+		// IndexIntervalRecords and IndexIntervalBytes make the index sparse:
+		// a record only gets an entry once this many records, or bytes of the
+		// store, follow the last entry. Reads scan forward from the closest
+		// entry. Every record gets an entry when both are 0. A sparse index
+		// grows past MaxIndexBytes when it needs to, so segments only roll
+		// on MaxStoreBytes.
+		IndexIntervalRecords uint64
+		IndexIntervalBytes   uint64
+	}
+	Sync struct {
+		// Policy decides when appended records are synced to stable storage.
+		Policy SyncPolicy
+		// Records is how many appends SyncEveryRecords lets through between syncs.
+		Records uint64
+		// Interval is how often SyncInterval syncs the active segment.
+		Interval time.Duration
+	}
+	// Compression is the codec records are compressed with before they're
+	// stored, nil stores them as they are.
+	Compression Codec
+	// Encryption, when set, has records encrypted with AES-GCM after
+	// they're compressed, using the keys it provides. nil stores them
+	// unencrypted. Indexes aren't encrypted, they only hold positions.
+	Encryption KeyProvider
+	// ReadOnly opens the log without changing anything on disk: stores and
+	// indexes are opened read-only, damage left by a crash is worked around
+	// in memory rather than repaired, the directory isn't locked and
+	// nothing runs in the background. Methods that would change the log
+	// return ErrReadOnly. A read-only log can be opened alongside the log
+	// writing to the directory; it sees the records there when it's opened.
+	ReadOnly bool
+	// Migrate has NewLog upgrade the sealed segments written in older
+	// store formats before it returns, see Log.Migrate. It's ignored when
+	// the log is read-only.
+	Migrate bool
+	// Compaction keeps only the latest record for each key in sealed
+	// segments, see Log.Compact.
+	Compaction struct {
+		// Enabled has the cleaner compact the log.
+		Enabled bool
+		// TombstoneRetention is how long a tombstone is kept after it's
+		// appended, giving consumers time to see the key was deleted.
+		TombstoneRetention time.Duration
+	}
+	// Retention has the cleaner remove the log's oldest sealed segments;
+	// the active segment is never removed.
+	Retention struct {
+		// MaxAge removes sealed segments whose newest record is older than
+		// this, 0 keeps them however old they are.
+		MaxAge time.Duration
+		// MaxBytes removes sealed segments while the log's stores take up
+		// more than this, 0 puts no limit on them.
+		MaxBytes uint64
+		// ConsumerGated keeps every sealed segment until all the consumers
+		// registered with Log.CommitOffset have committed past it. MaxAge
+		// and MaxBytes still decide when a segment goes, if they're set;
+		// otherwise it goes as soon as it's been consumed. Nothing is
+		// removed while no consumer is registered.
+		ConsumerGated bool
+		// HardMaxBytes removes sealed segments while the log's stores take
+		// up more than this, whether they've been consumed or not. 0 puts
+		// no limit on them.
+		HardMaxBytes uint64
+	}
+	// Tiering has the cleaner offload the oldest sealed segments to a blob
+	// store, see Log.Offload. Retention only removes local segments, the
+	// offloaded ones stay until the log is truncated past them.
+	Tiering struct {
+		// Store is where segments are offloaded to, nil keeps them local.
+		Store BlobStore
+		// MinAge offloads sealed segments whose newest record is older
+		// than this.
+		MinAge time.Duration
+		// CacheSegments is how many offloaded segments fetched for reads
+		// are kept on local disk, one when 0.
+		CacheSegments int
+	}
+	// Cleaner runs the log's background maintenance.
+	Cleaner struct {
+		// Interval is how often the cleaner runs, it doesn't run when 0.
+		Interval time.Duration
+		// OnEvent, when set, is called with every change the cleaner makes
+		// and every error it runs into, without the log's lock held.
+		OnEvent func(CleanerEvent)
 	}
 }
+
+// SyncPolicy trades append latency for durability: records that haven't
+// been synced are lost if the machine goes down.
+type SyncPolicy int
+
+const (
+	// SyncNone leaves writing records out to the operating system and only
+	// flushes them when the log is closed.
+	SyncNone SyncPolicy = iota
+	// SyncAlways syncs every record before Append returns.
+	SyncAlways
+	// SyncEveryRecords syncs once every Sync.Records appends; Append returns
+	// after the sync when it's the one completing the batch.
+	SyncEveryRecords
+	// SyncInterval syncs the active segment in the background every
+	// Sync.Interval, so at most that much of the latest data can be lost.
+	// Once a background sync fails, every append fails with its error until
+	// the log is reopened.
+	SyncInterval
+	// SyncOnRoll syncs a segment once it's full, before appending to the next.
+	SyncOnRoll
+)
@@ -0,0 +1,137 @@
+package log
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// consumersFile keeps the offsets consumers committed, in the log's directory.
+const consumersFile = "consumers.json"
+
+// CommitOffset records that the consumer has processed every record before
+// offset, registering it if it's new. With Retention.ConsumerGated set, no
+// segment is removed before every registered consumer has committed past it.
+// The offset is written to the log's directory before CommitOffset returns.
+func (log *Log) CommitOffset(consumer string, offset uint64) error {
+	if err := log.writable(); err != nil {
+		return err
+	}
+
+	log.consumersMutex.Lock()
+	defer log.consumersMutex.Unlock()
+
+	offsets := make(map[string]uint64, len(log.consumers)+1)
+	for name, off := range log.consumers {
+		offsets[name] = off
+	}
+	offsets[consumer] = offset
+
+	if err := saveConsumers(log.Dir, offsets); err != nil {
+		return err
+	}
+	log.consumers = offsets
+	return nil
+}
+
+// RemoveConsumer forgets the consumer, so retention no longer waits for it.
+func (log *Log) RemoveConsumer(consumer string) error {
+	if err := log.writable(); err != nil {
+		return err
+	}
+
+	log.consumersMutex.Lock()
+	defer log.consumersMutex.Unlock()
+
+	if _, ok := log.consumers[consumer]; !ok {
+		return nil
+	}
+
+	offsets := make(map[string]uint64, len(log.consumers))
+	for name, off := range log.consumers {
+		if name != consumer {
+			offsets[name] = off
+		}
+	}
+
+	if err := saveConsumers(log.Dir, offsets); err != nil {
+		return err
+	}
+	log.consumers = offsets
+	return nil
+}
+
+// ConsumerOffsets returns the offset each registered consumer committed.
+func (log *Log) ConsumerOffsets() map[string]uint64 {
+	log.consumersMutex.Lock()
+	defer log.consumersMutex.Unlock()
+
+	offsets := make(map[string]uint64, len(log.consumers))
+	for name, off := range log.consumers {
+		offsets[name] = off
+	}
+	return offsets
+}
+
+// consumed reports whether every registered consumer has committed an
+// offset past the segment's last one. It's false when there are none.
+func (log *Log) consumed(segment *segment) bool {
+	log.consumersMutex.Lock()
+	defer log.consumersMutex.Unlock()
+
+	if len(log.consumers) == 0 {
+		return false
+	}
+	for _, off := range log.consumers {
+		if off < segment.nextOffset {
+			return false
+		}
+	}
+	return true
+}
+
+// loadConsumers reads the committed offsets from the log's directory.
+func loadConsumers(dir string) (map[string]uint64, error) {
+	offsets := make(map[string]uint64)
+
+	p, err := ioutil.ReadFile(path.Join(dir, consumersFile))
+	if os.IsNotExist(err) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return offsets, json.Unmarshal(p, &offsets)
+}
+
+// saveConsumers replaces the committed offsets in the log's directory. The
+// offsets are written to a new file that's renamed over the old one, so a
+// crash leaves one or the other.
+func saveConsumers(dir string, offsets map[string]uint64) error {
+	p, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+
+	name := path.Join(dir, consumersFile)
+	file, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(p); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
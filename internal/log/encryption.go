@@ -0,0 +1,183 @@
+package log
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// KeyProvider supplies the keys records are encrypted with. Every encrypted
+// record carries the ID of its key, so keys can be rotated: new records use
+// the current key, and old ones decrypt as long as their key is available.
+// Keys are AES keys, 16, 24 or 32 bytes long.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new records with, and its ID.
+	CurrentKey() (id uint32, key []byte, err error)
+	// Key returns the key with the given ID.
+	Key(id uint32) ([]byte, error)
+}
+
+const (
+	// attributeEncrypted is set in a frame's attributes when the record is
+	// encrypted; the key ID and nonce follow the attributes.
+	attributeEncrypted = 0x10
+
+	keyIDWidth = 4
+)
+
+// encrypt seals p with the provider's current key and returns the key's ID,
+// the nonce and the sealed bytes in one slice. The attributes are
+// authenticated along with p, so they can't be changed either.
+func (store *store) encrypt(attributes uint8, p []byte) ([]byte, error) {
+	id, key, err := store.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := store.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, keyIDWidth+aead.NonceSize(), keyIDWidth+aead.NonceSize()+len(p)+aead.Overhead())
+	fileEncoding.PutUint32(out, id)
+	if _, err = io.ReadFull(rand.Reader, out[keyIDWidth:]); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, out[keyIDWidth:], p, []byte{attributes}), nil
+}
+
+// decrypt reverses encrypt, looking the key up by the ID in p.
+func (store *store) decrypt(attributes uint8, p []byte) ([]byte, error) {
+	if len(p) < keyIDWidth {
+		return nil, ErrDecrypt{}
+	}
+	id := fileEncoding.Uint32(p)
+
+	if store.keys == nil {
+		return nil, ErrUnknownKey{ID: id}
+	}
+	key, err := store.keys.Key(id)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := store.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	p = p[keyIDWidth:]
+	if len(p) < aead.NonceSize() {
+		return nil, ErrDecrypt{KeyID: id}
+	}
+	out, err := aead.Open(nil, p[:aead.NonceSize()], p[aead.NonceSize():], []byte{attributes})
+	if err != nil {
+		return nil, ErrDecrypt{KeyID: id}
+	}
+	return out, nil
+}
+
+// aead returns the AES-GCM cipher for the key, reusing it across records.
+func (store *store) aead(id uint32, key []byte) (cipher.AEAD, error) {
+	if aead, ok := store.aeads.Load(id); ok {
+		return aead.(cipher.AEAD), nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	store.aeads.Store(id, aead)
+	return aead, nil
+}
+
+// FileKeyProvider reads keys from a directory holding a file per key, named
+// after the key's ID with a .key extension and holding the raw key bytes.
+// The key with the highest ID is the current one. To rotate keys, add a
+// file with a higher ID and call Reload.
+type FileKeyProvider struct {
+	dir string
+
+	mutex   sync.RWMutex
+	keys    map[uint32][]byte
+	current uint32
+}
+
+// NewFileKeyProvider returns a provider of the keys in dir.
+func NewFileKeyProvider(dir string) (*FileKeyProvider, error) {
+	provider := &FileKeyProvider{dir: dir}
+	return provider, provider.Reload()
+}
+
+// Reload reads the keys in the provider's directory again.
+func (p *FileKeyProvider) Reload() error {
+	files, err := ioutil.ReadDir(p.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[uint32][]byte)
+	var current uint32
+	for _, file := range files {
+		if path.Ext(file.Name()) != ".key" {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(file.Name(), ".key"), 10, 32)
+		if err != nil {
+			continue
+		}
+
+		key, err := ioutil.ReadFile(path.Join(p.dir, file.Name()))
+		if err != nil {
+			return err
+		}
+		if _, err = aes.NewCipher(key); err != nil {
+			return fmt.Errorf("key %d: %w", id, err)
+		}
+
+		keys[uint32(id)] = key
+		if uint32(id) >= current {
+			current = uint32(id)
+		}
+	}
+
+	if len(keys) == 0 {
+		return fmt.Errorf("no keys in %s", p.dir)
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.keys, p.current = keys, current
+	return nil
+}
+
+func (p *FileKeyProvider) CurrentKey() (uint32, []byte, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *FileKeyProvider) Key(id uint32) ([]byte, error) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey{ID: id}
+	}
+	return key, nil
+}
@@ -0,0 +1,171 @@
+package log
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/require"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// TestEncryption tests that encrypted records never reach the disk in the
+// clear, that records written before a key rotation still decrypt, and that
+// records whose key is missing can't be read.
+func TestEncryption(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "encryption-keys-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyDir)
+
+	writeKey := func(name string, b byte) {
+		key := bytes.Repeat([]byte{b}, 32)
+		require.NoError(t, ioutil.WriteFile(path.Join(keyDir, name), key, 0600))
+	}
+	writeKey("1.key", 1)
+
+	keys, err := NewFileKeyProvider(keyDir)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "encryption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Compression = Gzip
+	c.Encryption = keys
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	secret := []byte("the secret value")
+	_, err = log.Append(&api.Record{Value: secret})
+	require.NoError(t, err)
+
+	writeKey("2.key", 2)
+	require.NoError(t, keys.Reload())
+	id, _, err := keys.CurrentKey()
+	require.NoError(t, err)
+	require.Equal(t, uint32(2), id)
+
+	_, err = log.Append(&api.Record{Value: secret})
+	require.NoError(t, err)
+
+	for off := uint64(0); off < 2; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, secret, record.Value)
+	}
+	require.NoError(t, log.Close())
+
+	stored, err := ioutil.ReadFile(path.Join(dir, "0.store"))
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(stored, secret))
+
+	// without the first key only the second record can be read
+	require.NoError(t, os.Remove(path.Join(keyDir, "1.key")))
+	require.NoError(t, keys.Reload())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+
+	_, err = log.Read(0)
+	require.Equal(t, ErrUnknownKey{ID: 1}, err)
+	record, err := log.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, secret, record.Value)
+	require.NoError(t, log.Close())
+
+	// and without a key provider neither can
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	_, err = log.Read(1)
+	require.Equal(t, ErrUnknownKey{ID: 2}, err)
+}
+
+// TestEncryptionWrongKey tests that records that don't decrypt with the key
+// under their key's ID fail opening the log, rather than being cut off as
+// torn writes when recovery scans them.
+func TestEncryptionWrongKey(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "encryption-wrong-key-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyDir)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(keyDir, "1.key"), bytes.Repeat([]byte{1}, 32), 0600))
+	keys, err := NewFileKeyProvider(keyDir)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "encryption-wrong-key-log-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Encryption = keys
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.IndexIntervalRecords = 10
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = log.Append(&api.Record{Value: []byte("the secret value")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	name := path.Join(dir, "0.store")
+	before, err := os.Stat(name)
+	require.NoError(t, err)
+
+	// the same key ID with different key material
+	require.NoError(t, ioutil.WriteFile(path.Join(keyDir, "1.key"), bytes.Repeat([]byte{2}, 32), 0600))
+	require.NoError(t, keys.Reload())
+
+	_, err = NewLog(dir, c)
+	decryptErr, ok := err.(ErrDecrypt)
+	require.True(t, ok, err)
+	require.Equal(t, uint32(1), decryptErr.KeyID)
+
+	after, err := os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, before.Size(), after.Size())
+}
+
+// TestEncryptionOlderEmptyStore tests that an active store left with just
+// an older format's header is started again in the current one, so records
+// appended to it are still encrypted.
+func TestEncryptionOlderEmptyStore(t *testing.T) {
+	keyDir, err := ioutil.TempDir("", "encryption-older-keys-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(keyDir)
+
+	require.NoError(t, ioutil.WriteFile(path.Join(keyDir, "1.key"), bytes.Repeat([]byte{1}, 32), 0600))
+	keys, err := NewFileKeyProvider(keyDir)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "encryption-older-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// a log closed right after rolling a segment in the checksum format
+	name := path.Join(dir, "0.store")
+	storeFile, err := os.Create(name)
+	require.NoError(t, err)
+	require.NoError(t, writeStoreHeader(storeFile, storeVersionChecksum))
+	require.NoError(t, storeFile.Close())
+
+	c := Config{}
+	c.Compression = Gzip
+	c.Encryption = keys
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, storeVersion, log.activeSegment.store.version)
+
+	secret := []byte("the secret value")
+	off, err := log.Append(&api.Record{Value: secret})
+	require.NoError(t, err)
+	record, err := log.Read(off)
+	require.NoError(t, err)
+	require.Equal(t, secret, record.Value)
+	require.NoError(t, log.Close())
+
+	stored, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(stored, secret))
+}
@@ -0,0 +1,208 @@
+package log
+
+import "fmt"
+
+// ErrOffsetMismatch is returned when a record in a store doesn't carry the
+// offset its place in the segment implies, so the index can't be rebuilt
+// from it.
+type ErrOffsetMismatch struct {
+	BaseOffset uint64
+	Position   uint64
+	Want       uint64
+	Got        uint64
+}
+
+func (e ErrOffsetMismatch) Error() string {
+	return fmt.Sprintf(
+		"segment %d: record at position %d has offset %d, want %d",
+		e.BaseOffset,
+		e.Position,
+		e.Got,
+		e.Want,
+	)
+}
+
+// ErrUnknownCodec is returned when a record was compressed by a codec that
+// hasn't been registered.
+type ErrUnknownCodec struct {
+	ID uint8
+}
+
+func (e ErrUnknownCodec) Error() string {
+	return fmt.Sprintf("unknown codec %d, register it with RegisterCodec", e.ID)
+}
+
+// ErrTruncated is returned by an iterator whose next record was removed from
+// the start of the log, by truncation or retention, while it was reading.
+type ErrTruncated struct {
+	Offset       uint64
+	LowestOffset uint64
+}
+
+func (e ErrTruncated) Error() string {
+	return fmt.Sprintf(
+		"offset %d was truncated, the lowest offset is now %d",
+		e.Offset,
+		e.LowestOffset,
+	)
+}
+
+// ErrUnknownKey is returned when a record was encrypted with a key the log's
+// key provider doesn't have, or the log has no key provider.
+type ErrUnknownKey struct {
+	ID uint32
+}
+
+func (e ErrUnknownKey) Error() string {
+	return fmt.Sprintf("unknown encryption key %d", e.ID)
+}
+
+// ErrDecrypt is returned when a record doesn't decrypt with the key its
+// frame names: the key provider has different key material under the key's
+// ID, or the record was tampered with. It's never taken for a torn write,
+// so a wrong key fails opening the log rather than cutting off records.
+type ErrDecrypt struct {
+	KeyID    uint32
+	Position uint64
+}
+
+func (e ErrDecrypt) Error() string {
+	return fmt.Sprintf("record at position %d failed to decrypt with key %d", e.Position, e.KeyID)
+}
+
+// ErrReadOnly is returned by the methods that change a log when it was
+// opened with Config.ReadOnly.
+type ErrReadOnly struct {
+	Dir string
+}
+
+func (e ErrReadOnly) Error() string {
+	return fmt.Sprintf("log %s is open read-only", e.Dir)
+}
+
+// ErrDirLocked is returned when a log's directory is already open, by
+// another process or another Log in this one.
+type ErrDirLocked struct {
+	Dir string
+}
+
+func (e ErrDirLocked) Error() string {
+	return fmt.Sprintf("log directory %s is in use by another log", e.Dir)
+}
+
+// ErrUnknownTopic is returned by a Manager asked for a topic that doesn't exist.
+type ErrUnknownTopic struct {
+	Topic string
+}
+
+func (e ErrUnknownTopic) Error() string {
+	return fmt.Sprintf("unknown topic %q", e.Topic)
+}
+
+// ErrTopicExists is returned when creating a topic that already exists.
+type ErrTopicExists struct {
+	Topic string
+}
+
+func (e ErrTopicExists) Error() string {
+	return fmt.Sprintf("topic %q already exists", e.Topic)
+}
+
+// ErrInvalidTopic is returned for a topic name that can't name a directory:
+// names are made of letters, digits, dots, underscores and dashes.
+type ErrInvalidTopic struct {
+	Topic string
+}
+
+func (e ErrInvalidTopic) Error() string {
+	return fmt.Sprintf("invalid topic name %q", e.Topic)
+}
+
+// ErrPartitionedTopic is returned when asking a Manager for the single log
+// of a topic that's split into partitions; use Manager.Topic instead.
+type ErrPartitionedTopic struct {
+	Topic string
+}
+
+func (e ErrPartitionedTopic) Error() string {
+	return fmt.Sprintf("topic %q is partitioned", e.Topic)
+}
+
+// ErrUnknownPartition is returned for a partition a topic doesn't have.
+type ErrUnknownPartition struct {
+	Topic     string
+	Partition int
+}
+
+func (e ErrUnknownPartition) Error() string {
+	return fmt.Sprintf("topic %q has no partition %d", e.Topic, e.Partition)
+}
+
+// ErrManifestVersion is returned when a log's manifest was written by a
+// newer version of the log, in a format this one doesn't know.
+type ErrManifestVersion struct {
+	Dir          string
+	Version      int
+	StoreVersion uint32
+}
+
+func (e ErrManifestVersion) Error() string {
+	return fmt.Sprintf(
+		"log %s has manifest version %d and store version %d, newer than %d and %d",
+		e.Dir,
+		e.Version,
+		e.StoreVersion,
+		manifestVersion,
+		storeVersion,
+	)
+}
+
+// ErrStoreVersion is returned when a store file was written by a newer
+// version of the log, in a format this one doesn't know.
+type ErrStoreVersion struct {
+	Name    string
+	Version uint32
+}
+
+func (e ErrStoreVersion) Error() string {
+	return fmt.Sprintf("store %s has version %d, newer than %d", e.Name, e.Version, storeVersion)
+}
+
+// ErrMigrationMismatch is returned when a segment rewritten in a newer store
+// format doesn't read back the same as the original, which is kept.
+type ErrMigrationMismatch struct {
+	Dir        string
+	BaseOffset uint64
+	Version    uint32
+}
+
+func (e ErrMigrationMismatch) Error() string {
+	return fmt.Sprintf(
+		"log %s: segment %d doesn't read back the same after migrating to store version %d",
+		e.Dir,
+		e.BaseOffset,
+		e.Version,
+	)
+}
+
+// ErrUnknownFile is returned when a log's directory holds a file that isn't
+// one of the log's, which usually means it isn't a log directory at all.
+type ErrUnknownFile struct {
+	Dir  string
+	Name string
+}
+
+func (e ErrUnknownFile) Error() string {
+	return fmt.Sprintf("log %s: unknown file %s", e.Dir, e.Name)
+}
+
+// ErrMissingSegment is returned when a segment the log's manifest lists
+// has no store file.
+type ErrMissingSegment struct {
+	Dir        string
+	BaseOffset uint64
+}
+
+func (e ErrMissingSegment) Error() string {
+	return fmt.Sprintf("log %s: segment %d is missing its store", e.Dir, e.BaseOffset)
+}
@@ -5,6 +5,7 @@ import (
 	"github.com/tysonmote/gommap"
 	"io"
 	"os"
+	"sort"
 )
 
 var (
@@ -18,6 +19,7 @@ type index struct {
 	file      *os.File
 	memoryMap gommap.MMap
 	size      uint64
+	readOnly  bool
 }
 
 // newIndex creates an index for the given file.
@@ -29,7 +31,8 @@ type index struct {
 func newIndex(file *os.File, config Config) (*index, error) {
 
 	index := &index{
-		file: file,
+		file:     file,
+		readOnly: config.ReadOnly,
 	}
 
 	fileInfo, err := os.Stat(file.Name())
@@ -39,7 +42,21 @@ func newIndex(file *os.File, config Config) (*index, error) {
 
 	index.size = uint64(fileInfo.Size())
 
-	if err = os.Truncate(file.Name(), int64(config.Segment.MaxIndexBytes)); err != nil {
+	// a read-only index is mapped as it is, an empty file can't be mapped at all
+	if index.readOnly {
+		if index.size > 0 {
+			index.memoryMap, err = gommap.Map(index.file.Fd(), gommap.PROT_READ, gommap.MAP_SHARED)
+		}
+		return index, err
+	}
+
+	// compaction can write an index past the max size, which mustn't lose entries
+	maxBytes := config.Segment.MaxIndexBytes
+	if index.size > maxBytes {
+		maxBytes = index.size
+	}
+
+	if err = os.Truncate(file.Name(), int64(maxBytes)); err != nil {
 		return nil, err
 	}
 
@@ -85,6 +102,93 @@ func (index *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// grow doubles the room for entries in the index file and maps it again,
+// for rebuilding an index that holds more entries than the segment's
+// max index size allows. Nobody may be reading the index while it does.
+func (index *index) grow() error {
+	maxBytes := 2 * uint64(len(index.memoryMap))
+	if maxBytes < index.size+entWidth {
+		maxBytes = index.size + entWidth
+	}
+
+	if err := index.memoryMap.UnsafeUnmap(); err != nil {
+		return err
+	}
+	if err := index.file.Truncate(int64(maxBytes)); err != nil {
+		return err
+	}
+
+	var err error
+	index.memoryMap, err = gommap.Map(index.file.Fd(), gommap.PROT_READ|gommap.PROT_WRITE, gommap.MAP_SHARED)
+	return err
+}
+
+// search returns the number of the last entry whose offset is at most in,
+// the closest indexed record at or before the one at offset in.
+func (index *index) search(in uint32) (int64, error) {
+	entries := int(index.size / entWidth)
+	i := sort.Search(entries, func(i int) bool {
+		return enc.Uint32(index.memoryMap[uint64(i)*entWidth:]) > in
+	})
+	if i == 0 {
+		return 0, io.EOF
+	}
+	return int64(i - 1), nil
+}
+
+// searchPos returns the first entry whose position is at least pos. The
+// time index keeps timestamps as positions, so there it finds the first
+// record stamped at or after a time.
+func (index *index) searchPos(pos uint64) (out uint32, _ uint64, err error) {
+	entries := int(index.size / entWidth)
+	i := sort.Search(entries, func(i int) bool {
+		return enc.Uint64(index.memoryMap[uint64(i)*entWidth+offWidth:]) >= pos
+	})
+	if i == entries {
+		return 0, 0, io.EOF
+	}
+	return index.Read(int64(i))
+}
+
+// validEntries returns the number of leading entries that could have been
+// written by Write: offsets and positions grow from one entry to the next,
+// with positions between first and size. A crash leaves the rest of the
+// memory-mapped file zero-filled, which fails these checks.
+func (index *index) validEntries(first, size uint64) uint64 {
+	var n uint64
+	var prevOff uint32
+	var prevPos uint64
+	for ; (n+1)*entWidth <= index.size && (n+1)*entWidth <= uint64(len(index.memoryMap)); n++ {
+		off, pos, err := index.Read(int64(n))
+		if err != nil || pos < first || pos >= size {
+			break
+		}
+		if n > 0 && (off <= prevOff || pos <= prevPos) {
+			break
+		}
+		prevOff, prevPos = off, pos
+	}
+	return n
+}
+
+// truncate keeps the first n entries and zeroes the rest of the memory map
+// so dropped entries can't be mistaken for valid ones later on. A read-only
+// index only stops reading past them.
+func (index *index) truncate(n uint64) {
+	index.size = n * entWidth
+	if index.readOnly {
+		return
+	}
+	for i := index.size; i < uint64(len(index.memoryMap)); i++ {
+		index.memoryMap[i] = 0
+	}
+}
+
+// sync commits the memory-mapped entries to the index file.
+func (index *index) sync() error {
+	return index.memoryMap.Sync(gommap.MS_SYNC)
+}
+
 // Name returns the index's fila path.
 func (index *index) Name() string {
 	return index.file.Name()
@@ -92,6 +196,13 @@ func (index *index) Name() string {
 
 func (index *index) Close() error {
 
+	if index.readOnly {
+		if index.file == nil {
+			return nil
+		}
+		return index.file.Close()
+	}
+
 	if err := index.memoryMap.Sync(gommap.MS_SYNC); err != nil {
 		return err
 	}
@@ -53,3 +53,29 @@ func TestIndex(t *testing.T) {
 	require.Equal(t, uint32(1), off)
 	require.Equal(t, entries[1].Pos, pos)
 }
+
+func TestIndexValidEntries(t *testing.T) {
+	f, err := ioutil.TempFile(os.TempDir(), "index_valid_test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	idx, err := newIndex(f, c)
+	require.NoError(t, err)
+
+	for i, pos := range []uint64{8, 30, 52} {
+		require.NoError(t, idx.Write(uint32(i), pos))
+	}
+
+	// an index that wasn't closed spans the whole memory-mapped file
+	idx.size = c.Segment.MaxIndexBytes
+	require.Equal(t, uint64(3), idx.validEntries(8, 74))
+
+	// entries pointing past the end of the store aren't valid
+	require.Equal(t, uint64(2), idx.validEntries(8, 52))
+
+	idx.truncate(1)
+	idx.size = c.Segment.MaxIndexBytes
+	require.Equal(t, uint64(1), idx.validEntries(8, 74))
+}
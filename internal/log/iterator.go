@@ -0,0 +1,202 @@
+package log
+
+import (
+	"context"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"os"
+	"sort"
+)
+
+// Iterator reads the log's records in order, from one segment's store to
+// the next, rather than looking every offset up like Read. Records removed
+// by compaction are skipped. Use it like:
+//
+//	it := log.NewIterator(from)
+//	for it.Next() {
+//		record := it.Record()
+//	}
+//	if err := it.Err(); err != nil {
+//	}
+//
+// An Iterator isn't safe for concurrent use.
+type Iterator struct {
+	log    *Log
+	follow context.Context
+
+	// segment and position are where the next record is read from; a nil
+	// segment has the iterator look its next offset up again
+	segment  *segment
+	position uint64
+	next     uint64
+
+	record *api.Record
+	err    error
+}
+
+// NewIterator returns an iterator reading the log from the record at offset
+// from, or the first record after it.
+func (log *Log) NewIterator(from uint64) *Iterator {
+	return &Iterator{log: log, next: from}
+}
+
+// Follow has Next wait at the head of the log for new records to be
+// appended, until ctx is done.
+func (it *Iterator) Follow(ctx context.Context) *Iterator {
+	it.follow = ctx
+	return it
+}
+
+// Next moves the iterator to the next record and reports whether there's
+// one. It returns false at the head of the log, unless it's following the
+// log, and after an error. If the next record is removed from the start of
+// the log while the iterator reads, Err returns ErrTruncated.
+func (it *Iterator) Next() bool {
+	for it.err == nil {
+		it.log.mutex.RLock()
+		lowest := it.log.segments[0].baseOffset
+		remote := (it.segment == nil || it.segment.closed) && it.next < lowest
+		var ok bool
+		var appended <-chan struct{}
+		if !remote {
+			ok, appended = it.advance()
+		}
+		it.log.mutex.RUnlock()
+
+		// offloaded segments are read without the lock, like Log.Read does
+		if remote {
+			if it.readRemote(lowest) {
+				return true
+			}
+			continue
+		}
+
+		if ok || it.err != nil || it.follow == nil {
+			return ok
+		}
+
+		select {
+		case <-appended:
+		case <-it.follow.Done():
+			it.err = it.follow.Err()
+		}
+	}
+	return false
+}
+
+// Record returns the record Next moved to.
+func (it *Iterator) Record() *api.Record {
+	return it.record
+}
+
+// Err returns the error that stopped the iterator, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// readRemote reads the next record from the offloaded segments, moving
+// the iterator on to the local ones starting at lowest once they run out.
+func (it *Iterator) readRemote(lowest uint64) bool {
+	it.segment = nil
+
+	record, err := it.log.readRemote(it.next)
+	switch err.(type) {
+	case nil:
+		it.record = record
+		it.next = record.Offset + 1
+		return true
+	case api.ErrOffsetOutOfRange:
+		lowest, _ = it.log.LowestOffset()
+		it.err = ErrTruncated{Offset: it.next, LowestOffset: lowest}
+	default:
+		if err == io.EOF {
+			it.next = lowest
+		} else {
+			it.err = err
+		}
+	}
+	return false
+}
+
+// advance reads the next record, or returns the channel that's closed once
+// records are appended if it's at the head of the log. The caller must hold
+// the read lock.
+func (it *Iterator) advance() (bool, <-chan struct{}) {
+	for {
+		// compaction and truncation close the segments they replace or remove
+		if it.segment == nil || it.segment.closed {
+			if !it.locate() {
+				return false, it.log.appended
+			}
+		}
+
+		if it.position >= it.segment.store.size {
+			next := it.log.segmentAfter(it.segment)
+			if next == nil {
+				return false, it.log.appended
+			}
+			it.segment, it.position = next, next.store.firstPosition()
+			continue
+		}
+
+		p, next, err := it.segment.store.readFrame(it.position)
+		if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+			corrupt.Offset = it.next
+			corrupt.BaseOffset = it.segment.baseOffset
+			err = corrupt
+		}
+		if err != nil {
+			it.err = err
+			return false, nil
+		}
+
+		record := &api.Record{}
+		if it.err = proto.Unmarshal(p, record); it.err != nil {
+			return false, nil
+		}
+
+		it.position = next
+		it.record = record
+		it.next = record.Offset + 1
+		return true, nil
+	}
+}
+
+// locate looks up where the iterator's next record is. It returns false if
+// the record hasn't been appended yet, or with the iterator's error set.
+func (it *Iterator) locate() bool {
+	it.segment = nil
+
+	for _, segment := range it.log.segments[it.log.segmentFor(it.next):] {
+		if segment.closed {
+			it.err = os.ErrClosed
+			return false
+		}
+
+		pos, err := segment.locate(it.next)
+		if err == io.EOF {
+			continue
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+
+		it.segment, it.position = segment, pos
+		return true
+	}
+	return false
+}
+
+// segmentAfter returns the segment that follows the given one, nil if it's
+// the last. The caller must hold the lock.
+func (log *Log) segmentAfter(segment *segment) *segment {
+	i := sort.Search(len(log.segments), func(i int) bool {
+		return log.segments[i].baseOffset > segment.baseOffset
+	})
+	if i == len(log.segments) {
+		return nil
+	}
+	return log.segments[i]
+}
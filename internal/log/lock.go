@@ -0,0 +1,41 @@
+package log
+
+import (
+	"os"
+	"path"
+	"syscall"
+)
+
+// lockFile is the file in a log's directory the open log holds a lock on.
+const lockFile = ".lock"
+
+// lock takes an exclusive advisory lock on the log's directory, so no other
+// Log, in this process or another, can open it while this one has it open.
+func (log *Log) lock() error {
+	file, err := os.OpenFile(path.Join(log.Dir, lockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if err == syscall.EWOULDBLOCK {
+			return ErrDirLocked{Dir: log.Dir}
+		}
+		return err
+	}
+
+	log.lockFile = file
+	return nil
+}
+
+// unlock releases the lock on the log's directory.
+func (log *Log) unlock() error {
+	if log.lockFile == nil {
+		return nil
+	}
+	// closing the file releases the lock
+	err := log.lockFile.Close()
+	log.lockFile = nil
+	return err
+}
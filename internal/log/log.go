@@ -1,15 +1,15 @@
 package log
 
 import (
+	"errors"
+	"fmt"
 	api "github.com/xhantimda/commitlog/api/v1"
 	"io"
-	"io/ioutil"
 	"os"
-	"path"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // NewLog creates and configures a Log instance.
@@ -20,38 +20,135 @@ func NewLog(dir string, conf Config) (*Log, error) {
 	if conf.Segment.MaxIndexBytes == 0 {
 		conf.Segment.MaxIndexBytes = 1024
 	}
+	if codec := conf.Compression; codec != nil && (codec.ID() == 0 || codec.ID() > maxCodecID) {
+		return nil, fmt.Errorf("codec ID %d out of range", codec.ID())
+	}
 	log := &Log{
 		Dir:    dir,
 		Config: conf,
 	}
-	return log, log.setup()
+	if err := log.setup(); err != nil || !conf.Migrate || conf.ReadOnly {
+		return log, err
+	}
+	if _, err := log.Migrate(); err != nil {
+		log.Close()
+		return nil, err
+	}
+	return log, nil
 }
 
 // setup ensures that the Log is set up with the segments that
 // already exist on disk or, if the log is new and has no existing segments,
 // bootstraps the initial segment
 func (log *Log) setup() error {
-	files, err := ioutil.ReadDir(log.Dir)
+	log.segments, log.activeSegment = nil, nil
+	log.recovered = nil
+	log.unsynced = 0
+	log.syncErr = nil
+	log.removedSegments, log.removedBytes = 0, 0
+	log.syncs = 0
+
+	// a read-only log doesn't lock the directory, the log writing to it may have it
+	if !log.Config.ReadOnly {
+		if err := os.MkdirAll(log.Dir, 0755); err != nil {
+			return err
+		}
+		if err := log.lock(); err != nil {
+			return err
+		}
+	}
+
+	consumers, err := loadConsumers(log.Dir)
+	if err == nil {
+		err = log.setupSegments()
+	}
+	if err == nil {
+		err = log.setupRemote()
+	}
+	if err == nil {
+		err = log.dropPartialBatch()
+	}
+	if err == nil {
+		err = log.saveManifest()
+	}
 	if err != nil {
+		log.closeSegments()
+		log.unlock()
 		return err
 	}
+	log.consumersMutex.Lock()
+	log.consumers = consumers
+	log.consumersMutex.Unlock()
+
+	log.appended = make(chan struct{})
+	log.done = make(chan struct{})
+	if !log.Config.ReadOnly {
+		log.startSyncer()
+		log.startCleaner()
+	}
+	return nil
+}
 
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix(file.Name(), path.Ext(file.Name()))
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
+// closeSegments closes the segments a failed setup opened, local and
+// offloaded, leaving the log without any.
+func (log *Log) closeSegments() {
+	for _, segment := range log.segments {
+		segment.Close()
 	}
+	log.segments, log.activeSegment = nil, nil
+	log.closeRemote()
+}
 
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
+// writable returns ErrReadOnly if the log was opened read-only.
+func (log *Log) writable() error {
+	if log.Config.ReadOnly {
+		return ErrReadOnly{Dir: log.Dir}
+	}
+	return nil
+}
 
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = log.newSegment(baseOffsets[i]); err != nil {
+// setupSegments opens the segments in the log's directory, finishing what
+// a crash interrupted, or creates the first one.
+func (log *Log) setupSegments() error {
+	if !log.Config.ReadOnly {
+		if err := finishCompactions(log.Dir); err != nil {
 			return err
 		}
-		i++
+	}
+
+	var err error
+	if log.manifest, err = loadManifest(log.Dir); err != nil {
+		return err
+	}
+
+	// every segment has a store, a missing index is rebuilt from it
+	baseOffsets, err := log.segmentBases()
+	if err != nil {
+		return err
+	}
+	if log.manifest == nil {
+		log.manifest = newManifest(log.Config)
+		// a log written before manifests has its offloaded segments found
+		// by listing the blob store, like one whose manifest predates them
+		if len(baseOffsets) > 0 {
+			log.manifest.Version = manifestVersionRemote - 1
+		}
+	}
+
+	for _, baseOffset := range baseOffsets {
+		if err = log.newSegment(baseOffset); err != nil {
+			return err
+		}
+	}
+
+	// a sealed segment holds every offset up to the next one's base, even
+	// when compaction removed the records at its end
+	for i := 1; i < len(log.segments); i++ {
+		log.segments[i-1].nextOffset = log.segments[i].baseOffset
+	}
+
+	if log.segments == nil && log.Config.ReadOnly {
+		return fmt.Errorf("no log in %s to open read-only", log.Dir)
 	}
 
 	if log.segments == nil {
@@ -59,14 +156,138 @@ func (log *Log) setup() error {
 			return err
 		}
 	}
+
+	if log.Config.ReadOnly {
+		return nil
+	}
+
+	// only append to a store written in the current format, older stores
+	// stay readable; one without records is simply started again
+	if active := log.activeSegment; active.store.version != storeVersion {
+		if active.nextOffset > active.baseOffset {
+			err = log.newSegment(active.nextOffset)
+		} else {
+			err = active.store.restart()
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	// setup saves the manifest once the offloaded segments are known too
 	return nil
 }
 
+// dropPartialBatch removes a batch cut short by a crash from the end of the
+// log: the records flagged as followed by more of their batch at the tail.
+// The batch may have rolled segments, so segments it filled entirely are
+// removed and the one it started in is cut where it started. A read-only
+// log leaves the files alone and reads the partial batch.
+func (log *Log) dropPartialBatch() error {
+	if log.Config.ReadOnly {
+		return nil
+	}
+
+	// walk back over the segments the batch filled, and empty ones
+	i := len(log.segments) - 1
+	var start uint64
+	partial := false
+	for ; i >= 0; i-- {
+		var err error
+		if start, err = log.segments[i].batchTail(); err != nil {
+			return err
+		}
+		if start < log.segments[i].store.size {
+			partial = true
+		}
+		if start > log.segments[i].store.firstPosition() || i == 0 {
+			break
+		}
+	}
+	if !partial {
+		return nil
+	}
+	// a segment without the batch's records ends where the next one starts
+	if start == log.segments[i].store.size && i < len(log.segments)-1 {
+		i++
+		start = log.segments[i].store.firstPosition()
+	}
+
+	removed := log.segments[i+1:]
+	segment := log.segments[i]
+	report := SegmentRecovery{BaseOffset: segment.baseOffset}
+	for _, seg := range removed {
+		report.DroppedRecords += seg.nextOffset - seg.baseOffset
+	}
+	next := segment.nextOffset
+	if err := segment.truncateTo(start); err != nil {
+		return err
+	}
+	report.DroppedRecords += next - segment.nextOffset
+	log.recovered = append(log.recovered, report)
+
+	log.segments = log.segments[:i+1]
+	log.activeSegment = segment
+	return log.removeSegments(removed...)
+}
+
+// startSyncer syncs the active segment every Sync.Interval in the background
+// when the log uses SyncInterval. A failed sync leaves it unknown which
+// records reached the disk, so it's returned by every Append after it until
+// the log is reopened.
+func (log *Log) startSyncer() {
+	if log.Config.Sync.Policy != SyncInterval || log.Config.Sync.Interval <= 0 {
+		return
+	}
+
+	done := log.done
+	log.background.Add(1)
+
+	go func() {
+		defer log.background.Done()
+
+		ticker := time.NewTicker(log.Config.Sync.Interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				// Append only reads syncErr under the write lock, so the read lock
+				// is enough to keep this goroutine's write from racing it
+				log.mutex.RLock()
+				if err := log.activeSegment.sync(); err != nil && log.syncErr == nil {
+					log.syncErr = err
+				}
+				log.mutex.RUnlock()
+			}
+		}
+	}()
+}
+
+// stopBackground stops the log's background goroutines and waits for them to return.
+func (log *Log) stopBackground() {
+	if log.done != nil {
+		close(log.done)
+		log.done = nil
+	}
+	log.background.Wait()
+}
+
 // newSegment creates a new segment, appends that segment to the log’s
 // slice of segments, and makes the new segment the active segment so that
 // subsequent append calls write to it.
 func (log *Log) newSegment(offset uint64) error {
 
+	// the active segment is sealed by the new one; a read-only log reads
+	// its stores from the files, which a log writing to them may truncate
+	if log.activeSegment != nil && !log.Config.ReadOnly {
+		if err := log.activeSegment.store.seal(); err != nil {
+			return err
+		}
+	}
+
 	seg, err := newSegment(log.Dir, offset, log.Config)
 	if err != nil {
 		return err
@@ -75,50 +296,349 @@ func (log *Log) newSegment(offset uint64) error {
 	log.segments = append(log.segments, seg)
 	log.activeSegment = seg
 
+	if seg.recovery.Repaired() {
+		log.recovered = append(log.recovered, seg.recovery)
+	}
+
 	return nil
 }
 
+// Recovered returns the repairs made to segments left behind by an unclean
+// shutdown when the log was opened.
+func (log *Log) Recovered() []SegmentRecovery {
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+
+	return log.recovered
+}
+
+// RebuildIndex throws away the index of the segment with the given base
+// offset and regenerates it from the segment's store.
+func (log *Log) RebuildIndex(baseOffset uint64) (SegmentRecovery, error) {
+	if err := log.writable(); err != nil {
+		return SegmentRecovery{}, err
+	}
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	for _, segment := range log.segments {
+		if segment.baseOffset == baseOffset {
+			return segment.rebuildIndex()
+		}
+	}
+	return SegmentRecovery{}, fmt.Errorf("no segment with base offset %d", baseOffset)
+}
+
+// RebuildIndexes regenerates the index of every segment from its store.
+func (log *Log) RebuildIndexes() ([]SegmentRecovery, error) {
+	if err := log.writable(); err != nil {
+		return nil, err
+	}
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	var reports []SegmentRecovery
+	for _, segment := range log.segments {
+		report, err := segment.rebuildIndex()
+		if err != nil {
+			return reports, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, nil
+}
+
 // Append appends a record to the log, if the segment has reached max capacity
 // then creates a new segment and sets it as the new active segment.
 func (log *Log) Append(record *api.Record) (uint64, error) {
+	return log.AppendBatch([]*api.Record{record})
+}
+
+// AppendBatch appends the records to the log with contiguous offsets and
+// returns the offset of the first one. The batch is all-or-nothing: it may
+// span segments as they fill, but if any record can't be written everything
+// the batch wrote is undone, and Read never sees part of a batch.
+// Concurrent appends are committed as a group, see commit.
+func (log *Log) AppendBatch(records []*api.Record) (uint64, error) {
+	if len(records) == 0 {
+		return 0, errors.New("append batch: no records")
+	}
+	if err := log.writable(); err != nil {
+		return 0, err
+	}
+
+	req := &pendingAppend{
+		records: records,
+		done:    make(chan struct{}, 1),
+	}
+
+	log.queueMutex.Lock()
+	log.queue = append(log.queue, req)
+
+	// wait for the append in progress to write this one or hand over to it
+	if log.committing {
+		log.queueMutex.Unlock()
+		<-req.done
+		if !req.lead {
+			return req.offset, req.err
+		}
+		log.queueMutex.Lock()
+	}
+
+	log.committing = true
+	group := log.queue
+	log.queue = nil
+	log.queueMutex.Unlock()
+
+	log.commit(group)
+
+	log.queueMutex.Lock()
+	if len(log.queue) > 0 {
+		next := log.queue[0]
+		next.lead = true
+		next.done <- struct{}{}
+	} else {
+		log.committing = false
+	}
+	log.queueMutex.Unlock()
+
+	return req.offset, req.err
+}
+
+// commit writes a group of appends to the log, syncs them once as the sync
+// policy asks and then wakes every waiting append with its own offset.
+func (log *Log) commit(group []*pendingAppend) {
 	log.mutex.Lock()
 	defer log.mutex.Unlock()
 
-	off, err := log.activeSegment.Append(record)
+	var appended uint64
+	for _, req := range group {
+		if req.err = log.syncErr; req.err != nil {
+			continue
+		}
+		if req.offset, req.err = log.appendBatch(req.records); req.err == nil {
+			appended += uint64(len(req.records))
+		}
+	}
+
+	if err := log.syncAppended(appended); err != nil {
+		for _, req := range group {
+			if req.err == nil {
+				req.offset, req.err = 0, err
+			}
+		}
+	}
+
+	// wake the iterators following the head of the log
+	if appended > 0 {
+		close(log.appended)
+		log.appended = make(chan struct{})
+	}
+
+	for _, req := range group {
+		req.done <- struct{}{}
+	}
+}
+
+// appendBatch writes the records to the log, rolling segments as they fill,
+// and undoes the whole batch if one of them fails. Every record but the last
+// is flagged as followed by more of its batch, so a batch that was only
+// partly written when the process died is dropped by recovery.
+// The caller must hold the write lock.
+func (log *Log) appendBatch(records []*api.Record) (uint64, error) {
+	mark := log.mark()
+
+	for i, record := range records {
+		if _, err := log.append(record, i < len(records)-1); err != nil {
+			if rollbackErr := log.rollback(mark); rollbackErr != nil {
+				return 0, rollbackErr
+			}
+			return 0, err
+		}
+	}
+
+	return mark.nextOffset, nil
+}
+
+// mark records where the log ends so appends after it can be rolled back.
+func (log *Log) mark() logMark {
+	return logMark{
+		segments:      len(log.segments),
+		nextOffset:    log.activeSegment.nextOffset,
+		indexSize:     log.activeSegment.index.size,
+		timeIndexSize: log.activeSegment.timeIndex.size,
+		lastTimestamp: log.activeSegment.lastTimestamp,
+		storeSize:     log.activeSegment.store.size,
+	}
+}
+
+// rollback removes everything appended to the log since mark.
+func (log *Log) rollback(mark logMark) error {
+	rolled := log.segments[mark.segments:]
+	log.segments = log.segments[:mark.segments]
+	log.activeSegment = log.segments[mark.segments-1]
+	if err := log.removeSegments(rolled...); err != nil {
+		return err
+	}
+	if err := log.activeSegment.store.unseal(); err != nil {
+		return err
+	}
+
+	log.activeSegment.index.truncate(mark.indexSize / entWidth)
+	log.activeSegment.timeIndex.truncate(mark.timeIndexSize / entWidth)
+	log.activeSegment.lastTimestamp = mark.lastTimestamp
+	log.activeSegment.nextOffset = mark.nextOffset
+	return log.activeSegment.store.truncate(mark.storeSize)
+}
+
+// append writes a record to the active segment and rolls a new one once
+// it's full; more flags the record as followed by more of its batch. The
+// caller must hold the write lock.
+func (log *Log) append(record *api.Record, more bool) (uint64, error) {
+	record.Timestamp = log.timestamp()
+
+	var attributes uint8
+	if more {
+		attributes = attributeBatchContinues
+	}
+	off, err := log.activeSegment.appendFrame(record, attributes)
 	if err != nil {
 		return 0, err
 	}
 
 	if log.activeSegment.IsMaxed() {
-		err = log.newSegment(off + 1)
+		if log.Config.Sync.Policy != SyncNone {
+			if err = log.activeSegment.sync(); err != nil {
+				return 0, err
+			}
+			log.unsynced = 0
+		}
+		if err = log.newSegment(off + 1); err == nil {
+			err = log.saveManifest()
+		}
 	}
 
 	return off, err
 }
 
-// Read reads the record stored at the given offset
-func (log *Log) Read(offset uint64) (*api.Record, error) {
+// timestamp returns the time to stamp an appended record with, in
+// milliseconds since the Unix epoch. It never goes back past the last
+// record's, even if the clock does, so records stay ordered by time.
+func (log *Log) timestamp() int64 {
+	now := time.Now().UnixMilli()
+	for i := len(log.segments) - 1; i >= 0; i-- {
+		if last := log.segments[i].lastTimestamp; last > 0 {
+			if now < last {
+				return last
+			}
+			break
+		}
+	}
+	return now
+}
+
+// OffsetForTime returns the offset of the first record appended at or after
+// t. If every record is older, it returns the offset the next record gets.
+// Records appended before the log stamped them are never returned.
+func (log *Log) OffsetForTime(t time.Time) (uint64, error) {
 	log.mutex.RLock()
 	defer log.mutex.RUnlock()
 
-	var seg *segment
+	timestamp := t.UnixMilli()
 	for _, segment := range log.segments {
-		// find segment that contains the offset based on the segments baseOffset
-		if segment.baseOffset <= offset && offset < segment.nextOffset {
-			seg = segment
-			break
+		if segment.lastTimestamp < timestamp {
+			continue
+		}
+		if off, ok := segment.offsetForTime(timestamp); ok {
+			return off, nil
 		}
 	}
+	return log.activeSegment.nextOffset, nil
+}
 
-	if seg == nil || seg.nextOffset <= offset {
-		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+// syncAppended syncs the active segment after n records were appended
+// if the log's sync policy asks for it.
+func (log *Log) syncAppended(n uint64) error {
+	if n == 0 {
+		return nil
 	}
+	switch log.Config.Sync.Policy {
+	case SyncAlways:
+	case SyncEveryRecords:
+		log.unsynced += n
+		if log.unsynced < log.Config.Sync.Records {
+			return nil
+		}
+		log.unsynced = 0
+	default:
+		return nil
+	}
+	log.syncs++
+	return log.activeSegment.sync()
+}
 
-	return seg.Read(offset)
+// Read reads the record stored at the given offset or, if compaction
+// removed it, the first record stored after it.
+// Offsets before the local segments are read from the offloaded ones.
+func (log *Log) Read(offset uint64) (*api.Record, error) {
+	log.mutex.RLock()
+
+	// fetching an offloaded segment mustn't hold up appends
+	if lowest := log.segments[0].baseOffset; offset < lowest {
+		log.mutex.RUnlock()
+		record, err := log.readRemote(offset)
+		if err == io.EOF {
+			return log.Read(lowest)
+		}
+		return record, err
+	}
+	defer log.mutex.RUnlock()
+
+	// a segment compaction emptied the end of sends the read on to the next one
+	for _, segment := range log.segments[log.segmentFor(offset):] {
+		record, err := segment.Read(offset)
+		if err == io.EOF {
+			continue
+		}
+		return record, err
+	}
+
+	return nil, api.ErrOffsetOutOfRange{Offset: offset}
+}
+
+// segmentFor returns the index of the first segment whose offsets run past
+// the given one, len(log.segments) if there's none. Reads at the head of
+// the log go straight to the active segment, reads that land in the same
+// segment as the previous one skip the search, and the rest binary search
+// the segments by offset. The caller must hold the lock.
+func (log *Log) segmentFor(offset uint64) int {
+	last := len(log.segments) - 1
+	if active := log.segments[last]; offset >= active.baseOffset {
+		if offset < active.nextOffset {
+			return last
+		}
+		return last + 1
+	}
+
+	// the hint is only a guess, it's checked against the segments it points at
+	if i := int(atomic.LoadInt64(&log.readHint)); i < last &&
+		log.segments[i].baseOffset <= offset && offset < log.segments[i].nextOffset {
+		return i
+	}
+
+	i := sort.Search(last, func(i int) bool {
+		return log.segments[i].nextOffset > offset
+	})
+	atomic.StoreInt64(&log.readHint, int64(i))
+	return i
 }
 
 // Close iterates over the segments and closes them
 func (log *Log) Close() error {
+	log.stopBackground()
+
 	log.mutex.Lock()
 	defer log.mutex.Unlock()
 
@@ -127,11 +647,22 @@ func (log *Log) Close() error {
 			return err
 		}
 	}
-	return nil
+	if err := log.closeRemote(); err != nil {
+		return err
+	}
+
+	// following iterators find the segments closed and stop
+	close(log.appended)
+	log.appended = make(chan struct{})
+	return log.unlock()
 }
 
 // Remove closes the log and then removes its data.
 func (log *Log) Remove() error {
+	if err := log.writable(); err != nil {
+		return err
+	}
+
 	if err := log.Close(); err != nil {
 		return err
 	}
@@ -140,18 +671,23 @@ func (log *Log) Remove() error {
 
 // Reset removes the log and then creates a new log to replace it.
 func (log *Log) Reset() error {
+	if err := log.writable(); err != nil {
+		return err
+	}
+
 	if err := log.Remove(); err != nil {
 		return err
 	}
 	return log.setup()
 }
 
-// LowestOffset returns the lowest offset in the log.
+// LowestOffset returns the lowest offset in the log, including the
+// segments offloaded to the blob store.
 func (log *Log) LowestOffset() (uint64, error) {
 	log.mutex.Lock()
 	defer log.mutex.Unlock()
 
-	return log.segments[0].baseOffset, nil
+	return log.lowestOffset(), nil
 }
 
 // HighestOffset returns the highest offset in the log.
@@ -166,24 +702,64 @@ func (log *Log) HighestOffset() (uint64, error) {
 	return off - 1, nil
 }
 
-// Truncate removes all segments whose highest offset is lower than lowest.
+// Truncate removes all segments whose highest offset is lower than lowest,
+// deleting offloaded ones from the blob store. The active segment is always
+// kept, so the log still has somewhere to append.
 func (log *Log) Truncate(lowest uint64) error {
+	if err := log.writable(); err != nil {
+		return err
+	}
+
 	log.mutex.Lock()
 	defer log.mutex.Unlock()
-	var segments []*segment
+
+	dropped, err := log.truncateRemote(lowest)
+	if err != nil {
+		return err
+	}
+	var segments, removed []*segment
 	for _, s := range log.segments {
-		if s.nextOffset <= lowest+1 {
-			if err := s.Remove(); err != nil {
-				return err
-			}
+		if s.nextOffset <= lowest+1 && s != log.activeSegment {
+			removed = append(removed, s)
 			continue
 		}
 		segments = append(segments, s)
 	}
 	log.segments = segments
+	if err = log.removeSegments(removed...); err != nil {
+		return err
+	}
+
+	// the manifest no longer lists the dropped segments, so their blobs
+	// are ignored even if a crash keeps them from being deleted
+	for _, base := range dropped {
+		if err = deleteBlobs(log.Config.Tiering.Store, base); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// Stats returns the log's size, how well its records compress and what
+// retention removed from it.
+func (log *Log) Stats() Stats {
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+
+	stats := Stats{
+		Segments:        len(log.segments),
+		RemovedSegments: log.removedSegments,
+		RemovedBytes:    log.removedBytes,
+		Syncs:           log.syncs,
+	}
+	for _, segment := range log.segments {
+		stats.StoredBytes += segment.store.size
+		stats.AppendedBytes += segment.store.appendedBytes
+		stats.EncodedBytes += segment.store.encodedBytes
+	}
+	return stats
+}
+
 // Reader returns an io.Reader to read the whole log
 func (log *Log) Reader() io.Reader {
 	log.mutex.RLock()
@@ -208,9 +784,101 @@ type originReader struct {
 }
 
 type Log struct {
+	// readHint is the index of the sealed segment the last read searched
+	// for; it's first so atomic operations find it 64-bit aligned
+	readHint int64
+
 	mutex         sync.RWMutex
 	Dir           string
 	Config        Config
 	activeSegment *segment
 	segments      []*segment
+	recovered     []SegmentRecovery
+	unsynced      uint64
+	syncErr       error
+	done          chan struct{}
+	background    sync.WaitGroup
+
+	queueMutex sync.Mutex
+	queue      []*pendingAppend
+	committing bool
+
+	// appended is closed, and replaced, whenever records are appended
+	appended chan struct{}
+
+	// lockFile holds the lock on the log's directory while it's open
+	lockFile *os.File
+
+	// manifest is the log's manifest as last saved, see saveManifest
+	manifest *manifest
+
+	// compactMutex keeps compactions from running concurrently
+	compactMutex sync.Mutex
+
+	// segments and store bytes removed by retention since the log was opened
+	removedSegments uint64
+	removedBytes    uint64
+
+	// syncs counts the syncs appends waited for since the log was opened
+	syncs uint64
+
+	// consumers holds the offsets consumers committed, as saved in the log's directory
+	consumersMutex sync.Mutex
+	consumers      map[string]uint64
+
+	// remote holds the segments offloaded to the blob store, oldest first,
+	// and cache the ones fetched back for reads, least recently used first;
+	// remoteMutex is taken after mutex when both are held; fetching has a
+	// channel for each segment being downloaded, closed once it's done
+	remoteMutex sync.Mutex
+	remote      []remoteSegment
+	cache       []*segment
+	fetching    map[uint64]chan struct{}
+}
+
+// Stats describes a log's contents.
+type Stats struct {
+	Segments int
+	// StoredBytes is the size of the log's store files.
+	StoredBytes uint64
+	// AppendedBytes and EncodedBytes count the bytes of the records appended
+	// since the log was opened, before and after compression.
+	AppendedBytes uint64
+	EncodedBytes  uint64
+	// RemovedSegments and RemovedBytes count the segments, and the bytes
+	// of their stores, that retention removed since the log was opened.
+	RemovedSegments uint64
+	RemovedBytes    uint64
+	// Syncs counts the syncs appends waited for since the log was opened;
+	// appends committed together share one.
+	Syncs uint64
+}
+
+// CompressionRatio returns how many times smaller compression made the
+// records appended since the log was opened.
+func (s Stats) CompressionRatio() float64 {
+	if s.EncodedBytes == 0 {
+		return 1
+	}
+	return float64(s.AppendedBytes) / float64(s.EncodedBytes)
+}
+
+// pendingAppend is a batch waiting in the queue to be committed.
+// lead is set when the append is woken to commit the queue itself.
+type pendingAppend struct {
+	records []*api.Record
+	offset  uint64
+	err     error
+	lead    bool
+	done    chan struct{}
+}
+
+// logMark is the end of the log at some point during an append.
+type logMark struct {
+	segments      int
+	nextOffset    uint64
+	indexSize     uint64
+	timeIndexSize uint64
+	lastTimestamp int64
+	storeSize     uint64
 }
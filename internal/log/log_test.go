@@ -1,12 +1,20 @@
 package log
 
 import (
+	"bytes"
+	"context"
+	"fmt"
 	"github.com/stretchr/testify/require"
 	api "github.com/xhantimda/commitlog/api/v1"
 	"google.golang.org/protobuf/proto"
+	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLog(t *testing.T) {
@@ -19,6 +27,8 @@ func TestLog(t *testing.T) {
 		"init with exisitng segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"truncate past the head":            testTruncatePastHead,
+		"corrupt record":                    testCorruptRecord,
 	} {
 		t.Run(title, func(t *testing.T) {
 			dir, err := ioutil.TempDir("", "store-test")
@@ -38,6 +48,10 @@ func TestLog(t *testing.T) {
 func testAppendRead(t *testing.T, log *Log) {
 	append := &api.Record{
 		Value: []byte("hello world"),
+		Key:   []byte("greeting"),
+		Headers: []*api.Header{
+			{Key: "content-type", Value: []byte("text/plain")},
+		},
 	}
 
 	off, err := log.Append(append)
@@ -47,6 +61,9 @@ func testAppendRead(t *testing.T, log *Log) {
 	read, err := log.Read(off)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
+	require.Equal(t, append.Key, read.Key)
+	require.Equal(t, append.Timestamp, read.Timestamp)
+	require.True(t, proto.Equal(append.Headers[0], read.Headers[0]))
 }
 
 // testOutOfRangeErr tests that the log returns an error when we
@@ -106,8 +123,11 @@ func testReader(t *testing.T, log *Log) {
 	b, err := ioutil.ReadAll(reader)
 	require.NoError(t, err)
 
+	frame := b[headerWidth:]
+	size := fileEncoding.Uint64(frame)
+
 	read := &api.Record{}
-	err = proto.Unmarshal(b[lenWidth:], read)
+	err = proto.Unmarshal(frame[lenWidth+crcWidth+attributesWidth:lenWidth+crcWidth+size], read)
 	require.NoError(t, err)
 	require.Equal(t, append.Value, read.Value)
 }
@@ -130,3 +150,1646 @@ func testTruncate(t *testing.T, log *Log) {
 	_, err = log.Read(0)
 	require.Error(t, err)
 }
+
+// testTruncatePastHead tests that truncating past the last record keeps the
+// active segment, so reads report the offset out of range and appends go on.
+func testTruncatePastHead(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(append)
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, log.Truncate(10))
+	require.Len(t, log.segments, 1)
+
+	_, err := log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+
+	off, err := log.Append(append)
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+// testCorruptRecord tests that a damaged record is reported with its
+// segment and position instead of being handed back to the caller.
+func testCorruptRecord(t *testing.T, log *Log) {
+	append := &api.Record{
+		Value: []byte("hello world"),
+	}
+
+	off, err := log.Append(append)
+	require.NoError(t, err)
+
+	// reading flushes the record to the store file
+	_, err = log.Read(off)
+	require.NoError(t, err)
+
+	f, err := os.OpenFile(log.segments[0].store.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte{0xff}, int64(headerWidth+lenWidth+crcWidth))
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	_, err = log.Read(off)
+	require.Equal(t, api.ErrCorruptRecord{
+		Offset:     off,
+		BaseOffset: 0,
+		Position:   headerWidth,
+	}, err)
+}
+
+// TestLegacySegments tests that segments written before stores carried
+// checksums can still be read, and that new records go to a fresh segment.
+func TestLegacySegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "legacy-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+
+	storeFile, err := os.Create(path.Join(dir, fmt.Sprintf("%d%s", 0, ".store")))
+	require.NoError(t, err)
+	indexFile, err := os.Create(path.Join(dir, fmt.Sprintf("%d%s", 0, ".index")))
+	require.NoError(t, err)
+
+	var pos uint64
+	for i := uint64(0); i < 2; i++ {
+		p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: i})
+		require.NoError(t, err)
+
+		frame := make([]byte, lenWidth+entWidth)
+		fileEncoding.PutUint64(frame, uint64(len(p)))
+		_, err = storeFile.Write(append(frame[:lenWidth], p...))
+		require.NoError(t, err)
+
+		enc.PutUint32(frame[lenWidth:], uint32(i))
+		enc.PutUint64(frame[lenWidth+offWidth:], pos)
+		_, err = indexFile.Write(frame[lenWidth:])
+		require.NoError(t, err)
+
+		pos += lenWidth + uint64(len(p))
+	}
+	require.NoError(t, storeFile.Close())
+	require.NoError(t, indexFile.Close())
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := uint64(0); i < 2; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.Equal(t, uint64(2), log.activeSegment.baseOffset)
+	require.Equal(t, storeVersion, log.activeSegment.store.version)
+}
+
+// TestRecover tests that a log left behind without being closed, with a
+// zero-filled index and a partially written record at the end of its store,
+// is repaired when it's opened again.
+func TestRecover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	o, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// flush the records without closing, then drop the last index entry
+	// and tear a record off halfway through writing it
+	_, err = o.Read(2)
+	require.NoError(t, err)
+	o.activeSegment.index.truncate(2)
+
+	f, err := os.OpenFile(o.activeSegment.store.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	torn := make([]byte, lenWidth+crcWidth+3)
+	fileEncoding.PutUint64(torn, 64)
+	_, err = f.Write(torn)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// a process that dies loses its lock on the directory
+	require.NoError(t, o.unlock())
+	n, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	require.Equal(t, []SegmentRecovery{{
+		BaseOffset:     0,
+		IndexedRecords: 1,
+		TruncatedBytes: uint64(len(torn)),
+	}}, n.Recovered())
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+
+	for i := uint64(0); i < 3; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+
+	off, err = n.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+}
+
+// TestRecoverCorruption tests that a damaged record with good records
+// after it fails the open instead of being cut off with them.
+func TestRecoverCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "recover-corruption-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	o, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, pos, err := o.activeSegment.index.Read(3)
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	// flip a bit in the last byte of record 2, then lose the index
+	name := path.Join(dir, "0.store")
+	stored, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	stored[pos-1] ^= 1
+	require.NoError(t, ioutil.WriteFile(name, stored, 0644))
+	require.NoError(t, os.Remove(path.Join(dir, "0.index")))
+
+	_, err = NewLog(dir, c)
+	corrupt, ok := err.(api.ErrCorruptRecord)
+	require.True(t, ok, err)
+	require.Equal(t, uint64(2), corrupt.Offset)
+
+	info, err := os.Stat(name)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(stored)), info.Size())
+}
+
+// TestSetupFailureCloses tests that a log that fails to open closes the
+// segments it opened and releases its directory's lock.
+func TestSetupFailureCloses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "setup-failure-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	o, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 6; i++ {
+		_, err := o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(o.segments) > 2)
+	damaged := o.segments[len(o.segments)-2]
+	_, pos, err := damaged.index.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+
+	// damage the first record of a segment after others, then lose its index
+	name := damaged.store.Name()
+	stored, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	stored[pos-1] ^= 1
+	require.NoError(t, ioutil.WriteFile(name, stored, 0644))
+	require.NoError(t, os.Remove(damaged.index.Name()))
+
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	_, err = NewLog(dir, c)
+	require.IsType(t, api.ErrCorruptRecord{}, err)
+	after, err := ioutil.ReadDir("/proc/self/fd")
+	require.NoError(t, err)
+	require.Equal(t, len(fds), len(after))
+
+	locker := &Log{Dir: dir}
+	require.NoError(t, locker.lock())
+	require.NoError(t, locker.unlock())
+}
+
+// TestRebuildIndex tests that deleted indexes are regenerated from their
+// stores when the log is opened and on demand.
+func TestRebuildIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	o, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 6; i++ {
+		_, err := o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(o.segments) > 2)
+	require.NoError(t, o.Close())
+
+	for _, s := range o.segments {
+		require.NoError(t, os.Remove(s.index.Name()))
+	}
+
+	n, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, len(o.segments), len(n.segments))
+
+	for i := uint64(0); i < 6; i++ {
+		read, err := n.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+	}
+
+	reports, err := n.RebuildIndexes()
+	require.NoError(t, err)
+
+	var indexed uint64
+	for _, report := range reports {
+		indexed += report.IndexedRecords
+		require.Zero(t, report.TruncatedBytes)
+	}
+	require.Equal(t, uint64(6), indexed)
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+// TestRebuildIndexGrows tests that an index rebuilt under a smaller max
+// index size than its store was written with grows to fit every record,
+// rather than cutting the store down to what fits.
+func TestRebuildIndexGrows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild-grow-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	o, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 200; i++ {
+		_, err := o.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, o.Close())
+	require.NoError(t, os.Remove(path.Join(dir, "0.index")))
+
+	c.Segment.MaxIndexBytes = 1024
+	n, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRecovery{{IndexedRecords: 200}}, n.Recovered())
+
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(199), off)
+
+	reports, err := n.RebuildIndexes()
+	require.NoError(t, err)
+	require.Equal(t, []SegmentRecovery{{IndexedRecords: 200}}, reports)
+
+	read, err := n.Read(199)
+	require.NoError(t, err)
+	require.Equal(t, uint64(199), read.Offset)
+	require.NoError(t, n.Close())
+}
+
+// TestRebuildIndexOffsetMismatch tests that a store whose records don't
+// carry contiguous offsets can't be indexed.
+func TestRebuildIndexOffsetMismatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rebuild-mismatch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: 7})
+	require.NoError(t, err)
+	_, pos, err := log.activeSegment.store.Append(p)
+	require.NoError(t, err)
+
+	_, err = log.RebuildIndex(0)
+	require.Equal(t, ErrOffsetMismatch{
+		BaseOffset: 0,
+		Position:   pos,
+		Want:       2,
+		Got:        7,
+	}, err)
+}
+
+// TestSyncPolicy tests that each sync policy writes appended records out to
+// the store file when it promises to.
+func TestSyncPolicy(t *testing.T) {
+	onDisk := func(t *testing.T, log *Log) uint64 {
+		info, err := os.Stat(log.activeSegment.store.Name())
+		require.NoError(t, err)
+		return uint64(info.Size())
+	}
+	append := &api.Record{Value: []byte("hello world")}
+
+	for title, testCase := range map[string]struct {
+		configure func(c *Config)
+		check     func(t *testing.T, log *Log)
+	}{
+		"always": {
+			configure: func(c *Config) { c.Sync.Policy = SyncAlways },
+			check: func(t *testing.T, log *Log) {
+				for i := 0; i < 3; i++ {
+					_, err := log.Append(append)
+					require.NoError(t, err)
+					require.Equal(t, log.activeSegment.store.size, onDisk(t, log))
+				}
+			},
+		},
+		"every records": {
+			configure: func(c *Config) {
+				c.Sync.Policy = SyncEveryRecords
+				c.Sync.Records = 2
+			},
+			check: func(t *testing.T, log *Log) {
+				_, err := log.Append(append)
+				require.NoError(t, err)
+				require.Less(t, onDisk(t, log), log.activeSegment.store.size)
+
+				_, err = log.Append(append)
+				require.NoError(t, err)
+				require.Equal(t, log.activeSegment.store.size, onDisk(t, log))
+			},
+		},
+		"interval": {
+			configure: func(c *Config) {
+				c.Sync.Policy = SyncInterval
+				c.Sync.Interval = 10 * time.Millisecond
+			},
+			check: func(t *testing.T, log *Log) {
+				_, err := log.Append(append)
+				require.NoError(t, err)
+				require.Eventually(t, func() bool {
+					log.mutex.RLock()
+					defer log.mutex.RUnlock()
+					return onDisk(t, log) == log.activeSegment.store.size
+				}, time.Second, 5*time.Millisecond)
+
+				// a failed background sync fails every append after it
+				failed := fmt.Errorf("sync failed")
+				log.mutex.Lock()
+				log.syncErr = failed
+				log.mutex.Unlock()
+				for i := 0; i < 2; i++ {
+					_, err = log.Append(append)
+					require.Equal(t, failed, err)
+				}
+			},
+		},
+		"on roll": {
+			configure: func(c *Config) {
+				c.Sync.Policy = SyncOnRoll
+				c.Segment.MaxStoreBytes = 64
+			},
+			check: func(t *testing.T, log *Log) {
+				for len(log.segments) == 1 {
+					_, err := log.Append(append)
+					require.NoError(t, err)
+				}
+				sealed := log.segments[0].store
+				info, err := os.Stat(sealed.Name())
+				require.NoError(t, err)
+				require.Equal(t, sealed.size, uint64(info.Size()))
+			},
+		},
+	} {
+		t.Run(title, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sync-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			testCase.configure(&c)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			testCase.check(t, log)
+			require.NoError(t, log.Close())
+		})
+	}
+}
+
+// TestConcurrentAppend tests that appends committed together from many
+// goroutines each get their own offset and land in the log intact.
+func TestConcurrentAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "concurrent-append-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+	c.Sync.Policy = SyncAlways
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	const goroutines, appends = 16, 50
+	offsets := make(chan uint64, goroutines*appends)
+	errs := make(chan error, goroutines)
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < appends; i++ {
+				off, err := log.Append(&api.Record{
+					Value: []byte(fmt.Sprintf("%d-%d", g, i)),
+				})
+				if err != nil {
+					errs <- err
+					return
+				}
+				offsets <- off
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(offsets)
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+
+	seen := make(map[uint64]bool)
+	for off := range offsets {
+		require.False(t, seen[off])
+		seen[off] = true
+
+		read, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, read.Offset)
+	}
+	require.Len(t, seen, goroutines*appends)
+
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(goroutines*appends-1), off)
+
+	// appends queued behind a commit are written as one group with one sync:
+	// the first waits for the lock held here, the rest queue behind it
+	syncs := log.Stats().Syncs
+	log.mutex.Lock()
+	errs = make(chan error, goroutines)
+	for g := 0; g < goroutines; g++ {
+		go func() {
+			_, err := log.Append(&api.Record{Value: []byte("grouped")})
+			errs <- err
+		}()
+	}
+	require.Eventually(t, func() bool {
+		log.queueMutex.Lock()
+		defer log.queueMutex.Unlock()
+		return len(log.queue) == goroutines-1
+	}, time.Second, time.Millisecond)
+	log.mutex.Unlock()
+	for g := 0; g < goroutines; g++ {
+		require.NoError(t, <-errs)
+	}
+	require.Equal(t, syncs+2, log.Stats().Syncs)
+}
+
+func BenchmarkAppendParallel(b *testing.B) {
+	dir, err := ioutil.TempDir("", "append-bench")
+	require.NoError(b, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	c.Sync.Policy = SyncAlways
+	log, err := NewLog(dir, c)
+	require.NoError(b, err)
+	defer log.Close()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := log.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// TestAppendBatch tests that a batch gets contiguous offsets across the
+// segments it fills, and that a batch which can't be written whole leaves
+// no trace in the log.
+func TestAppendBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "append-batch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	batch := func(n int) []*api.Record {
+		records := make([]*api.Record, n)
+		for i := range records {
+			records[i] = &api.Record{Value: []byte(fmt.Sprintf("record %d", i))}
+		}
+		return records
+	}
+
+	off, err := log.AppendBatch(batch(5))
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+	require.True(t, len(log.segments) > 1)
+
+	for i := uint64(0); i < 5; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, []byte(fmt.Sprintf("record %d", i)), read.Value)
+	}
+
+	// a directory where a later segment's store goes makes rolling fail
+	// partway through the next batch
+	perSegment := log.segments[1].baseOffset - log.segments[0].baseOffset
+	next := log.activeSegment.baseOffset + 2*perSegment
+	blocked := path.Join(dir, fmt.Sprintf("%d%s", next, ".store"))
+	require.NoError(t, os.Mkdir(blocked, 0755))
+
+	// a new millisecond gives the batch's first record a time index entry
+	segments := len(log.segments)
+	timeIndexSize := log.activeSegment.timeIndex.size
+	lastTimestamp := log.activeSegment.lastTimestamp
+	time.Sleep(2 * time.Millisecond)
+	_, err = log.AppendBatch(batch(10))
+	require.Error(t, err)
+	require.Len(t, log.segments, segments)
+	require.Equal(t, timeIndexSize, log.activeSegment.timeIndex.size)
+	require.Equal(t, lastTimestamp, log.activeSegment.lastTimestamp)
+
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	_, err = log.Read(5)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+
+	require.NoError(t, os.Remove(blocked))
+	off, err = log.AppendBatch(batch(10))
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+
+	off, err = log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(14), off)
+}
+
+// TestRecoverPartialBatch tests that recovery drops a batch the process died
+// partway through writing, along with the segments it rolled, and keeps the
+// batches before it.
+func TestRecoverPartialBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partial-batch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	_, err = log.AppendBatch([]*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	})
+	require.NoError(t, err)
+	segments := len(log.segments)
+
+	// the process dies before the batch's last record is written
+	log.mutex.Lock()
+	for i := 0; i < 6; i++ {
+		_, err = log.append(&api.Record{Value: []byte("hello world")}, true)
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > segments)
+	log.mutex.Unlock()
+	require.NoError(t, log.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	require.Len(t, log.segments, segments)
+	off, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), off)
+	recovered := log.Recovered()
+	require.Equal(t, uint64(6), recovered[len(recovered)-1].DroppedRecords)
+
+	off, err = log.Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	read, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("third"), read.Value)
+}
+
+// TestCompression tests that records are compressed with the log's codec,
+// that changing the codec leaves earlier records readable and that stats
+// report how much was saved.
+func TestCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compression-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	value := []byte(strings.Repeat(`{"hello":"world"}`, 32))
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Compression = Gzip
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+	}
+
+	stats := log.Stats()
+	require.Greater(t, stats.CompressionRatio(), float64(5))
+	require.Less(t, stats.StoredBytes, uint64(len(value)))
+	require.NoError(t, log.Close())
+
+	// records compressed by other codecs share the segment
+	for _, codec := range []Codec{Flate, Zlib, nil} {
+		c.Compression = codec
+		log, err = NewLog(dir, c)
+		require.NoError(t, err)
+		_, err = log.Append(&api.Record{Value: value})
+		require.NoError(t, err)
+		require.NoError(t, log.Close())
+	}
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Len(t, log.segments, 1)
+
+	for i := uint64(0); i < 6; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, value, read.Value)
+	}
+}
+
+// TestSparseIndex tests that a sparse index only gets an entry every so
+// many records or bytes, and that every record can still be read, before
+// and after the log is opened again.
+func TestSparseIndex(t *testing.T) {
+	for title, configure := range map[string]func(c *Config){
+		"every records": func(c *Config) { c.Segment.IndexIntervalRecords = 4 },
+		"every bytes":   func(c *Config) { c.Segment.IndexIntervalBytes = 120 },
+	} {
+		t.Run(title, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "sparse-index-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			c := Config{}
+			c.Segment.MaxStoreBytes = 1024
+			// a sparse index grows past its max size rather than rolling the segment
+			c.Segment.MaxIndexBytes = 2 * entWidth
+			configure(&c)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+
+			for i := 0; i < 10; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+
+			// records take about 35 bytes in the store, so both settings index every 4th
+			require.Len(t, log.segments, 1)
+			require.Equal(t, 3*entWidth, log.activeSegment.index.size)
+
+			read := func(log *Log) {
+				for i := uint64(0); i < 10; i++ {
+					record, err := log.Read(i)
+					require.NoError(t, err)
+					require.Equal(t, i, record.Offset)
+				}
+				_, err := log.Read(10)
+				require.Error(t, err)
+			}
+			read(log)
+
+			// reopening without closing leaves the index file zero-filled
+			require.NoError(t, log.unlock())
+			n, err := NewLog(dir, c)
+			require.NoError(t, err)
+			require.Empty(t, n.Recovered())
+			read(n)
+
+			off, err := n.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+			require.Equal(t, uint64(10), off)
+		})
+	}
+}
+
+// TestOffsetForTime tests that records are stamped with the time they're
+// appended and can be found by it, across segments and after reopening.
+func TestOffsetForTime(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offset-for-time-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	var times []time.Time
+	for i := 0; i < 8; i++ {
+		// leave a millisecond on either side so records don't share the time
+		time.Sleep(2 * time.Millisecond)
+		times = append(times, time.Now())
+		time.Sleep(2 * time.Millisecond)
+
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 2)
+
+	find := func(log *Log) {
+		var last int64
+		for i := uint64(0); i < 8; i++ {
+			read, err := log.Read(i)
+			require.NoError(t, err)
+			require.GreaterOrEqual(t, read.Timestamp, last)
+			last = read.Timestamp
+
+			off, err := log.OffsetForTime(times[i])
+			require.NoError(t, err)
+			require.Equal(t, i, off)
+		}
+
+		off, err := log.OffsetForTime(time.Now().Add(time.Hour))
+		require.NoError(t, err)
+		require.Equal(t, uint64(8), off)
+	}
+	find(log)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	find(log)
+}
+
+// TestTimeIndexGrows tests that the time index grows as it needs to, rather
+// than rolling a segment whose sparse offset index still has room.
+func TestTimeIndexGrows(t *testing.T) {
+	dir, err := ioutil.TempDir("", "time-index-grows-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1 << 20
+	c.Segment.MaxIndexBytes = 10 * entWidth
+	c.Segment.IndexIntervalRecords = 100
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 100; i++ {
+		time.Sleep(time.Millisecond)
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 1)
+	require.Equal(t, entWidth, log.activeSegment.index.size)
+	require.True(t, log.activeSegment.timeIndex.size > timeIndexBytes)
+
+	read, err := log.Read(99)
+	require.NoError(t, err)
+	off, err := log.OffsetForTime(time.UnixMilli(read.Timestamp))
+	require.NoError(t, err)
+	require.Equal(t, uint64(99), off)
+}
+
+// TestCompaction tests that compaction keeps the latest record for each key
+// in sealed segments along with unkeyed records, that removed offsets read
+// as the next record kept, and that tombstones outlive their retention only
+// until the next compaction after it.
+func TestCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compaction-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var events []CleanerEvent
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Segment.IndexIntervalRecords = 2
+	c.Compaction.TombstoneRetention = time.Hour
+	c.Cleaner.OnEvent = func(event CleanerEvent) { events = append(events, event) }
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	records := []*api.Record{
+		{Key: []byte("a"), Value: []byte("a1")},
+		{Key: []byte("b"), Value: []byte("b1")},
+		{Value: []byte("unkeyed")},
+		{Key: []byte("a"), Value: []byte("a2")},
+		{Key: []byte("c"), Value: []byte("c1")},
+		{Key: []byte("b"), Value: []byte("b2")},
+		{Key: []byte("a"), Value: []byte("a3")},
+		{Key: []byte("c")},
+		{Key: []byte("b"), Value: []byte("b3")},
+		{Key: []byte("a"), Value: []byte("a4")},
+	}
+	for _, record := range records {
+		_, err := log.Append(record)
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 2)
+
+	// the latest record for a key in the sealed segments is kept
+	sealed := log.activeSegment.baseOffset
+	latest := map[string]uint64{}
+	for off := uint64(0); off < sealed; off++ {
+		if key := records[off].Key; key != nil {
+			latest[string(key)] = off
+		}
+	}
+	kept := func(tombstones bool) []uint64 {
+		var offsets []uint64
+		for off := uint64(0); off < uint64(len(records)); off++ {
+			record := records[off]
+			if off < sealed && record.Key != nil &&
+				(latest[string(record.Key)] != off || (!tombstones && record.Value == nil)) {
+				continue
+			}
+			offsets = append(offsets, off)
+		}
+		return offsets
+	}
+
+	check := func(log *Log, want []uint64) {
+		var got []uint64
+		for off := want[0]; off < uint64(len(records)); {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			require.True(t, record.Offset >= off)
+			require.Equal(t, records[record.Offset].Value, record.Value)
+			got = append(got, record.Offset)
+			off = record.Offset + 1
+		}
+		require.Equal(t, want, got)
+
+		_, err := log.Read(uint64(len(records)))
+		require.Error(t, err)
+
+		got = nil
+		it := log.NewIterator(0)
+		for it.Next() {
+			got = append(got, it.Record().Offset)
+		}
+		require.NoError(t, it.Err())
+		require.Equal(t, want, got)
+	}
+
+	require.NoError(t, log.Compact())
+	check(log, kept(true))
+	require.NotEmpty(t, events)
+	for _, event := range events {
+		require.NotEqual(t, CleanerFailed, event.Kind)
+		require.True(t, event.Records > 0)
+	}
+
+	// a compacted segment can be opened again and have its index rebuilt
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Empty(t, log.Recovered())
+	check(log, kept(true))
+
+	_, err = log.RebuildIndexes()
+	require.NoError(t, err)
+	check(log, kept(true))
+
+	// once their retention is up, tombstones go too
+	time.Sleep(2 * time.Millisecond)
+	log.Config.Compaction.TombstoneRetention = 0
+	require.NoError(t, log.Compact())
+	check(log, kept(false))
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(len(records)), off)
+}
+
+// TestCompactionCrash tests that opening a log finishes a compaction that
+// was interrupted after its store was swapped in, and throws away one that
+// was interrupted before.
+func TestCompactionCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compaction-crash-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	write := func(name string) {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), []byte("cleaned"), 0644))
+	}
+
+	// segment 0's store was swapped, segment 5's wasn't
+	write("0.index.cleaned")
+	write("5.store.cleaned")
+	write("5.index.cleaned")
+	require.NoError(t, finishCompactions(dir))
+
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.Equal(t, "0.index", files[0].Name())
+}
+
+// TestCompactionConcurrentAppend tests that a segment is compacted without
+// holding the log's lock, so appends go on while it's rewritten.
+func TestCompactionConcurrentAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "compaction-append-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Key: []byte("key"), Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 1)
+
+	// appending from inside the rewrite deadlocks if it holds the lock
+	appended := false
+	_, err = log.compactSegment(log.segments[0], func(record *api.Record) bool {
+		if !appended {
+			appended = true
+			done := make(chan error, 1)
+			go func() {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				require.NoError(t, err)
+			case <-time.After(5 * time.Second):
+				t.Fatal("append blocked by compaction")
+			}
+		}
+		return false
+	})
+	require.NoError(t, err)
+	require.True(t, appended)
+}
+
+// TestRetention tests that retention removes the oldest sealed segments
+// once they're too old or the log is too big, but never the active one.
+func TestRetention(t *testing.T) {
+	for title, configure := range map[string]func(c *Config){
+		"max age":   func(c *Config) { c.Retention.MaxAge = time.Millisecond },
+		"max bytes": func(c *Config) { c.Retention.MaxBytes = 200 },
+	} {
+		t.Run(title, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "retention-test")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			events := make(chan CleanerEvent, 16)
+			c := Config{}
+			c.Segment.MaxStoreBytes = 128
+			c.Cleaner.Interval = time.Millisecond
+			c.Cleaner.OnEvent = func(event CleanerEvent) { events <- event }
+			configure(&c)
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+
+			for i := 0; i < 10; i++ {
+				_, err := log.Append(&api.Record{Value: []byte("hello world")})
+				require.NoError(t, err)
+			}
+
+			// the cleaner gets rid of every sealed segment past the limit
+			enforced := func() bool {
+				stats := log.Stats()
+				if stats.Segments == 1 {
+					return true
+				}
+				return c.Retention.MaxBytes > 0 && stats.StoredBytes <= c.Retention.MaxBytes
+			}
+			require.Eventually(t, enforced, time.Second, time.Millisecond)
+
+			lowest, err := log.LowestOffset()
+			require.NoError(t, err)
+			require.True(t, lowest > 0)
+
+			var removed uint64
+			for removed < lowest {
+				select {
+				case event := <-events:
+					require.NotEqual(t, CleanerFailed, event.Kind, "%v", event.Err)
+					require.Equal(t, removed, event.BaseOffset)
+					removed += event.Records
+				case <-time.After(time.Second):
+					t.Fatal("no event for a removed segment")
+				}
+			}
+			require.Equal(t, lowest, removed)
+			require.True(t, log.Stats().RemovedSegments > 0)
+
+			_, err = log.Read(lowest - 1)
+			require.Error(t, err)
+			for off := lowest; off < 10; off++ {
+				read, err := log.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, read.Offset)
+			}
+		})
+	}
+}
+
+// TestConsumerRetention tests that consumer-gated retention waits for every
+// registered consumer to commit past a segment, that commits survive the
+// log being opened again, and that the hard cap overrides slow consumers.
+func TestConsumerRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consumer-retention-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var events []CleanerEvent
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Retention.ConsumerGated = true
+	c.Cleaner.OnEvent = func(event CleanerEvent) { events = append(events, event) }
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 2)
+	second := log.segments[1].baseOffset
+
+	lowest := func(log *Log) uint64 {
+		off, err := log.LowestOffset()
+		require.NoError(t, err)
+		return off
+	}
+
+	// nothing goes until every consumer is past it
+	require.NoError(t, log.EnforceRetention())
+	require.Equal(t, uint64(0), lowest(log))
+
+	require.NoError(t, log.CommitOffset("slow", 0))
+	require.NoError(t, log.CommitOffset("fast", 10))
+	require.NoError(t, log.EnforceRetention())
+	require.Equal(t, uint64(0), lowest(log))
+
+	require.NoError(t, log.CommitOffset("slow", second))
+	require.NoError(t, log.EnforceRetention())
+	require.Equal(t, second, lowest(log))
+	require.Len(t, events, 1)
+	require.Equal(t, SegmentConsumed, events[0].Kind)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, map[string]uint64{"slow": second, "fast": 10}, log.ConsumerOffsets())
+
+	// the hard cap removes segments the slow consumer hasn't got to
+	log.Config.Retention.HardMaxBytes = log.Stats().StoredBytes - 1
+	require.NoError(t, log.EnforceRetention())
+	require.True(t, lowest(log) > second)
+	require.Equal(t, SegmentCapped, events[len(events)-1].Kind)
+
+	// once the slow consumer is gone only the fast one counts
+	log.Config.Retention.HardMaxBytes = 0
+	require.NoError(t, log.RemoveConsumer("slow"))
+	require.NoError(t, log.EnforceRetention())
+	require.Len(t, log.segments, 1)
+	require.Equal(t, map[string]uint64{"fast": 10}, log.ConsumerOffsets())
+}
+
+// BenchmarkRead benchmarks reading from sealed segments and from the active
+// segment as the number of segments grows; lookups shouldn't slow down with it.
+func BenchmarkRead(b *testing.B) {
+	for _, segments := range []int{16, 256, 4096} {
+		dir, err := ioutil.TempDir("", "read-benchmark")
+		require.NoError(b, err)
+
+		// every record fills a segment
+		c := Config{}
+		c.Segment.MaxStoreBytes = 1
+		log, err := NewLog(dir, c)
+		require.NoError(b, err)
+
+		for i := 0; i < segments; i++ {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(b, err)
+		}
+		_, err = log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(b, err)
+		active := uint64(segments)
+
+		b.Run(fmt.Sprintf("%d segments/sealed", segments), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				// stride through the segments so the last one read doesn't help
+				if _, err := log.Read(uint64(i*7919) % active); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d segments/sequential", segments), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(uint64(i) % active); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("%d segments/active", segments), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if _, err := log.Read(active); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+
+		require.NoError(b, log.Remove())
+	}
+}
+
+// TestIterator tests that an iterator reads records in order across
+// segments, waits for new ones when it follows the log and reports records
+// truncated away underneath it.
+func TestIterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iterator-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	append := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}
+	append(10)
+	require.True(t, len(log.segments) > 2)
+
+	it := log.NewIterator(3)
+	for want := uint64(3); want < 10; want++ {
+		require.True(t, it.Next())
+		require.Equal(t, want, it.Record().Offset)
+	}
+	require.False(t, it.Next())
+	require.NoError(t, it.Err())
+
+	// a following iterator picks up records as they're appended
+	ctx, cancel := context.WithCancel(context.Background())
+	offsets := make(chan uint64)
+	it = log.NewIterator(8).Follow(ctx)
+	go func() {
+		for it.Next() {
+			offsets <- it.Record().Offset
+		}
+		close(offsets)
+	}()
+	for want := uint64(8); want < 10; want++ {
+		require.Equal(t, want, <-offsets)
+	}
+	append(2)
+	for want := uint64(10); want < 12; want++ {
+		require.Equal(t, want, <-offsets)
+	}
+	cancel()
+	_, ok := <-offsets
+	require.False(t, ok)
+	require.Equal(t, context.Canceled, it.Err())
+
+	// truncating the records ahead of an iterator stops it
+	it = log.NewIterator(0)
+	require.True(t, it.Next())
+	require.NoError(t, log.Truncate(log.segments[1].nextOffset))
+	require.False(t, it.Next())
+	truncated, ok := it.Err().(ErrTruncated)
+	require.True(t, ok)
+	require.Equal(t, uint64(1), truncated.Offset)
+	require.Equal(t, log.segments[0].baseOffset, truncated.LowestOffset)
+}
+
+// TestSnapshot tests that a snapshot keeps the log as it was when it was
+// taken while the log changes, and that a log can be restored from it.
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	append := func(n int) {
+		for i := 0; i < n; i++ {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+	}
+	append(5)
+
+	snapshot, err := log.Snapshot()
+	require.NoError(t, err)
+	defer snapshot.Close()
+
+	before, err := ioutil.ReadAll(log.Reader())
+	require.NoError(t, err)
+	require.Equal(t, int64(len(before)), snapshot.Size())
+	require.Equal(t, uint64(0), snapshot.LowestOffset())
+	require.Equal(t, uint64(5), snapshot.NextOffset())
+
+	// the log moves on without the snapshot
+	append(5)
+	require.NoError(t, log.Truncate(log.segments[1].nextOffset))
+
+	after, err := ioutil.ReadAll(snapshot.Reader())
+	require.NoError(t, err)
+	require.Equal(t, before, after)
+
+	// copying the snapshot's files restores the log as it was
+	restoreDir, err := ioutil.TempDir("", "snapshot-restore-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(restoreDir)
+
+	for _, f := range snapshot.Files() {
+		p, err := ioutil.ReadAll(f.Reader())
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path.Join(restoreDir, f.Name), p, 0644))
+	}
+
+	restored, err := NewLog(restoreDir, c)
+	require.NoError(t, err)
+	for off := uint64(0); off < 5; off++ {
+		record, err := restored.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	_, err = restored.Read(5)
+	require.Error(t, err)
+}
+
+// TestDirLock tests that a log's directory can't be opened twice at once,
+// and can be again once the log holding it is closed.
+func TestDirLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dir-lock-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	_, err = NewLog(dir, Config{})
+	require.Equal(t, ErrDirLocked{Dir: dir}, err)
+
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	// Reset takes the lock again after removing the log
+	require.NoError(t, log.Reset())
+	_, err = NewLog(dir, Config{})
+	require.Equal(t, ErrDirLocked{Dir: dir}, err)
+	require.NoError(t, log.Remove())
+}
+
+// TestReadOnly tests that a log can be opened read-only alongside the log
+// writing to the directory, reads what it wrote, refuses to change anything
+// and leaves the files as they were.
+func TestReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "read-only-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Sync.Policy = SyncAlways
+	writer, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := writer.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	files := func() map[string][]byte {
+		contents := map[string][]byte{}
+		infos, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		for _, info := range infos {
+			p, err := ioutil.ReadFile(path.Join(dir, info.Name()))
+			require.NoError(t, err)
+			contents[info.Name()] = p
+		}
+		return contents
+	}
+	before := files()
+
+	c.ReadOnly = true
+	reader, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	for off := uint64(0); off < 10; off++ {
+		record, err := reader.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+
+	_, err = reader.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrReadOnly{Dir: dir}, err)
+	require.Equal(t, ErrReadOnly{Dir: dir}, reader.Truncate(0))
+	require.Equal(t, ErrReadOnly{Dir: dir}, reader.Compact())
+
+	require.NoError(t, reader.Close())
+	require.Equal(t, before, files())
+
+	// the writer carries on, and reopening shows its new records
+	off, err := writer.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	reader, err = NewLog(dir, c)
+	require.NoError(t, err)
+	record, err := reader.Read(10)
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), record.Offset)
+	require.NoError(t, reader.Close())
+
+	empty, err := ioutil.TempDir("", "read-only-empty-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(empty)
+	_, err = NewLog(empty, c)
+	require.Error(t, err)
+}
+
+// TestReadOnlyWithoutIndex tests that a read-only log finds the records of
+// a segment whose index is missing by scanning its store.
+func TestReadOnlyWithoutIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "read-only-without-index-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	writer, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := writer.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, writer.Close())
+	require.NoError(t, os.Remove(path.Join(dir, "0.index")))
+
+	c.ReadOnly = true
+	reader, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer reader.Close()
+
+	for off := uint64(0); off < 5; off++ {
+		record, err := reader.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	_, err = reader.Read(5)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 5}, err)
+
+	it := reader.NewIterator(2)
+	var offsets []uint64
+	for it.Next() {
+		offsets = append(offsets, it.Record().Offset)
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, []uint64{2, 3, 4}, offsets)
+}
+
+// slowBlobStore holds up the first blob fetched until it's released.
+type slowBlobStore struct {
+	BlobStore
+	once     sync.Once
+	fetching chan struct{}
+	release  chan struct{}
+}
+
+func (s *slowBlobStore) Get(name string) (io.ReadCloser, error) {
+	s.once.Do(func() {
+		close(s.fetching)
+		<-s.release
+	})
+	return s.BlobStore.Get(name)
+}
+
+// TestTieringSlowFetch tests that appends, rolls included, and reads of the
+// local segments carry on while an offloaded segment is downloaded.
+func TestTieringSlowFetch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiering-slow-fetch-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	blobs, err := NewDirBlobStore(path.Join(dir, "blobs"))
+	require.NoError(t, err)
+	slow := &slowBlobStore{
+		BlobStore: blobs,
+		fetching:  make(chan struct{}),
+		release:   make(chan struct{}),
+	}
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Tiering.Store = slow
+	log, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	time.Sleep(2 * time.Millisecond)
+	log.Config.Tiering.MinAge = time.Millisecond
+	require.NoError(t, log.Offload())
+
+	read := make(chan error, 1)
+	go func() {
+		record, err := log.Read(0)
+		if err == nil && record.Offset != 0 {
+			err = fmt.Errorf("read offset %d", record.Offset)
+		}
+		read <- err
+	}()
+	<-slow.fetching
+
+	segments := len(log.segments)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > segments)
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), lowest)
+	record, err := log.Read(19)
+	require.NoError(t, err)
+	require.Equal(t, uint64(19), record.Offset)
+
+	close(slow.release)
+	require.NoError(t, <-read)
+}
+
+func TestTiering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tiering-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	blobs, err := NewDirBlobStore(path.Join(dir, "blobs"))
+	require.NoError(t, err)
+
+	var events []CleanerEvent
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Tiering.Store = blobs
+	c.Cleaner.OnEvent = func(event CleanerEvent) {
+		events = append(events, event)
+	}
+	log, err := NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	sealed := log.Stats().Segments - 1
+	require.True(t, sealed > 1)
+
+	// nothing is old enough yet
+	log.Config.Tiering.MinAge = time.Hour
+	require.NoError(t, log.Offload())
+	require.Empty(t, events)
+
+	time.Sleep(2 * time.Millisecond)
+	log.Config.Tiering.MinAge = time.Millisecond
+	require.NoError(t, log.Offload())
+	require.Len(t, events, sealed)
+	for _, event := range events {
+		require.Equal(t, SegmentOffloaded, event.Kind)
+	}
+	require.Equal(t, 1, log.Stats().Segments)
+
+	names, err := blobs.List()
+	require.NoError(t, err)
+	require.Len(t, names, 3*sealed)
+
+	check := func(log *Log) {
+		lowest, err := log.LowestOffset()
+		require.NoError(t, err)
+		require.Equal(t, uint64(0), lowest)
+
+		for off := uint64(0); off < 10; off++ {
+			record, err := log.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, off, record.Offset)
+		}
+
+		it := log.NewIterator(0)
+		var off uint64
+		for ; it.Next(); off++ {
+			require.Equal(t, off, it.Record().Offset)
+		}
+		require.NoError(t, it.Err())
+		require.Equal(t, uint64(10), off)
+	}
+	check(log)
+
+	// the offloaded segments are found again when the log is reopened
+	require.NoError(t, log.Close())
+	log, err = NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	check(log)
+	require.Len(t, log.manifest.Remote, sealed)
+
+	// truncating deletes offloaded segments from the blob store
+	require.NoError(t, log.Truncate(events[0].Records))
+	names, err = blobs.List()
+	require.NoError(t, err)
+	require.Len(t, names, 3*(sealed-1))
+
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, events[1].BaseOffset, lowest)
+	_, err = log.Read(0)
+	require.Equal(t, api.ErrOffsetOutOfRange{Offset: 0}, err)
+
+	it := log.NewIterator(0)
+	require.False(t, it.Next())
+	require.Equal(t, ErrTruncated{Offset: 0, LowestOffset: lowest}, it.Err())
+
+	// blobs the manifest doesn't list, like those of a truncation that
+	// crashed before deleting them, don't bring truncated records back
+	for _, ext := range segmentExts {
+		require.NoError(t, blobs.Put("0"+ext, bytes.NewReader([]byte("stale"))))
+	}
+	require.NoError(t, log.Close())
+	log, err = NewLog(path.Join(dir, "log"), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	reopened, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, lowest, reopened)
+}
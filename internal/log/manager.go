@@ -0,0 +1,373 @@
+package log
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxTopicLength keeps topic names within what file systems allow for a
+// directory name.
+const maxTopicLength = 255
+
+// Manager hosts topics, each in a directory named after the topic under the
+// manager's data directory. A topic is either a single log, kept in the
+// topic's directory, or split into partitions, each a log in a numbered
+// directory under the topic's. Topics are opened when they're first asked
+// for and stay open until they're deleted or the manager is closed. Every
+// log is opened with the manager's Config; a blob store for tiering is
+// shared by keeping each log's segments under the topic's name.
+type Manager struct {
+	Dir    string
+	Config Config
+
+	mutex  sync.Mutex
+	topics map[string]*Topic
+	closed bool
+}
+
+// NewManager returns a manager of the topics in dir, creating the directory
+// if it doesn't exist.
+func NewManager(dir string, conf Config) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &Manager{
+		Dir:    dir,
+		Config: conf,
+		topics: make(map[string]*Topic),
+	}, nil
+}
+
+// Create creates a topic and returns its log. It returns ErrTopicExists if
+// the topic already exists.
+func (m *Manager) Create(topic string) (*Log, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.check(topic); err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(m.topicDir(topic)); err == nil {
+		return nil, ErrTopicExists{Topic: topic}
+	}
+
+	t, err := m.create(topic, 0)
+	if err != nil {
+		return nil, err
+	}
+	return t.partitions[0], nil
+}
+
+// CreatePartitioned creates a topic split into the given number of
+// partitions. It returns ErrTopicExists if the topic already exists.
+func (m *Manager) CreatePartitioned(topic string, partitions int) (*Topic, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.check(topic); err != nil {
+		return nil, err
+	}
+	if partitions < 1 {
+		return nil, fmt.Errorf("topic %q needs at least one partition", topic)
+	}
+	if _, err := os.Stat(m.topicDir(topic)); err == nil {
+		return nil, ErrTopicExists{Topic: topic}
+	}
+	return m.create(topic, partitions)
+}
+
+// Open returns an existing topic's log. It returns ErrUnknownTopic if the
+// topic doesn't exist and ErrPartitionedTopic if it has partitions.
+func (m *Manager) Open(topic string) (*Log, error) {
+	t, err := m.Topic(topic)
+	if err != nil {
+		return nil, err
+	}
+	if t.partitioned {
+		return nil, ErrPartitionedTopic{Topic: topic}
+	}
+	return t.partitions[0], nil
+}
+
+// Log returns a topic's log, creating the topic if it doesn't exist. It
+// returns ErrPartitionedTopic if the topic has partitions.
+func (m *Manager) Log(topic string) (*Log, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.check(topic); err != nil {
+		return nil, err
+	}
+
+	t, ok := m.topics[topic]
+	if !ok {
+		var err error
+		if t, err = m.load(topic); os.IsNotExist(err) {
+			t, err = m.create(topic, 0)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if t.partitioned {
+		return nil, ErrPartitionedTopic{Topic: topic}
+	}
+	return t.partitions[0], nil
+}
+
+// Topic returns an existing topic, partitioned or not. It returns
+// ErrUnknownTopic if the topic doesn't exist.
+func (m *Manager) Topic(topic string) (*Topic, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.check(topic); err != nil {
+		return nil, err
+	}
+	if t, ok := m.topics[topic]; ok {
+		return t, nil
+	}
+
+	t, err := m.load(topic)
+	if os.IsNotExist(err) {
+		return nil, ErrUnknownTopic{Topic: topic}
+	}
+	return t, err
+}
+
+// Topics returns the names of the topics, sorted.
+func (m *Manager) Topics() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(m.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var topics []string
+	for _, file := range files {
+		if file.IsDir() && validTopic(file.Name()) {
+			topics = append(topics, file.Name())
+		}
+	}
+	sort.Strings(topics)
+	return topics, nil
+}
+
+// Delete closes a topic's logs and removes them. It returns ErrUnknownTopic
+// if the topic doesn't exist.
+func (m *Manager) Delete(topic string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if err := m.check(topic); err != nil {
+		return err
+	}
+
+	t, ok := m.topics[topic]
+	if !ok {
+		var err error
+		if t, err = m.load(topic); os.IsNotExist(err) {
+			return ErrUnknownTopic{Topic: topic}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	delete(m.topics, topic)
+	for _, log := range t.partitions {
+		if err := log.Remove(); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(m.topicDir(topic)); err != nil {
+		return err
+	}
+
+	// the topic's offloaded segments go with it
+	if blobs := m.Config.Tiering.Store; blobs != nil {
+		names, err := blobs.List()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if strings.HasPrefix(name, topic+"/") {
+				if err = blobs.Delete(name); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes every open topic. The manager can't be used afterwards.
+func (m *Manager) Close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.closed = true
+
+	var err error
+	for name, t := range m.topics {
+		if closeErr := t.close(); err == nil {
+			err = closeErr
+		}
+		delete(m.topics, name)
+	}
+	return err
+}
+
+// check returns an error if the manager is closed or the topic name isn't
+// valid. The caller must hold the lock.
+func (m *Manager) check(topic string) error {
+	if m.closed {
+		return os.ErrClosed
+	}
+	if !validTopic(topic) {
+		return ErrInvalidTopic{Topic: topic}
+	}
+	return nil
+}
+
+// load opens a topic that exists on disk, with as many partitions as it
+// has numbered directories. It returns an error satisfying os.IsNotExist
+// if there's no such topic. The caller must hold the lock.
+func (m *Manager) load(topic string) (*Topic, error) {
+	files, err := ioutil.ReadDir(m.topicDir(topic))
+	if err != nil {
+		return nil, err
+	}
+
+	var partitions []int
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		if id, err := strconv.Atoi(file.Name()); err == nil && strconv.Itoa(id) == file.Name() {
+			partitions = append(partitions, id)
+		}
+	}
+
+	sort.Ints(partitions)
+	for i, id := range partitions {
+		if id != i {
+			return nil, fmt.Errorf("topic %q: partition %d is missing", topic, i)
+		}
+	}
+	return m.open(topic, len(partitions))
+}
+
+// create creates the logs of a topic that doesn't exist yet, like open. If
+// one of them fails, the topic's directory is removed along with the logs
+// already created in it, so loading the topic later doesn't find it with
+// partitions missing. The caller must hold the lock.
+func (m *Manager) create(topic string, partitions int) (*Topic, error) {
+	t, err := m.open(topic, partitions)
+	if err != nil {
+		os.RemoveAll(m.topicDir(topic))
+		return nil, err
+	}
+	return t, nil
+}
+
+// open opens or creates the logs of a topic with the given number of
+// partitions, or of an unpartitioned topic when it's 0. The caller must
+// hold the lock.
+func (m *Manager) open(topic string, partitions int) (*Topic, error) {
+	t := &Topic{
+		Name:        topic,
+		Partitioner: KeyHashPartitioner{},
+		partitioned: partitions > 0,
+	}
+
+	dirs := []string{topic}
+	if partitions > 0 {
+		dirs = make([]string, partitions)
+		for i := range dirs {
+			dirs[i] = path.Join(topic, strconv.Itoa(i))
+		}
+	}
+
+	for _, dir := range dirs {
+		conf := m.Config
+		if conf.Tiering.Store != nil {
+			conf.Tiering.Store = prefixBlobStore{BlobStore: conf.Tiering.Store, prefix: dir + "/"}
+		}
+
+		log, err := NewLog(path.Join(m.Dir, dir), conf)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.partitions = append(t.partitions, log)
+	}
+
+	m.topics[topic] = t
+	return t, nil
+}
+
+func (m *Manager) topicDir(topic string) string {
+	return path.Join(m.Dir, topic)
+}
+
+// validTopic reports whether a topic name can be used as a directory name:
+// letters, digits, dots, underscores and dashes, other than . and ..
+func validTopic(topic string) bool {
+	if topic == "" || topic == "." || topic == ".." || len(topic) > maxTopicLength {
+		return false
+	}
+	for _, c := range topic {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// prefixBlobStore keeps a log's blobs apart from the other logs' in a
+// shared blob store by prefixing their names.
+type prefixBlobStore struct {
+	BlobStore
+	prefix string
+}
+
+func (s prefixBlobStore) Put(name string, r io.Reader) error {
+	return s.BlobStore.Put(s.prefix+name, r)
+}
+
+func (s prefixBlobStore) Get(name string) (io.ReadCloser, error) {
+	return s.BlobStore.Get(s.prefix + name)
+}
+
+func (s prefixBlobStore) Delete(name string) error {
+	return s.BlobStore.Delete(s.prefix + name)
+}
+
+// List only returns the log's own blobs; a partitioned topic's blobs are
+// under its partitions' prefixes, so an unpartitioned topic's skips them.
+func (s prefixBlobStore) List() ([]string, error) {
+	names, err := s.BlobStore.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var own []string
+	for _, name := range names {
+		if rest := strings.TrimPrefix(name, s.prefix); rest != name && !strings.Contains(rest, "/") {
+			own = append(own, rest)
+		}
+	}
+	return own, nil
+}
@@ -0,0 +1,145 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestManager(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewManager(dir, Config{})
+	require.NoError(t, err)
+
+	_, err = m.Open("orders")
+	require.Equal(t, ErrUnknownTopic{Topic: "orders"}, err)
+
+	orders, err := m.Create("orders")
+	require.NoError(t, err)
+	_, err = m.Create("orders")
+	require.Equal(t, ErrTopicExists{Topic: "orders"}, err)
+
+	// Log creates topics as they're asked for
+	payments, err := m.Log("payments")
+	require.NoError(t, err)
+	same, err := m.Log("payments")
+	require.NoError(t, err)
+	require.Same(t, payments, same)
+
+	for _, topic := range []string{"", ".", "..", "a/b", "a b"} {
+		_, err = m.Log(topic)
+		require.Equal(t, ErrInvalidTopic{Topic: topic}, err)
+	}
+
+	for i := 0; i < 3; i++ {
+		_, err = orders.Append(&api.Record{Value: []byte("order")})
+		require.NoError(t, err)
+	}
+	off, err := payments.Append(&api.Record{Value: []byte("payment")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), off)
+
+	topics, err := m.Topics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders", "payments"}, topics)
+
+	// the topics' logs are opened again after the manager is
+	require.NoError(t, m.Close())
+	_, err = m.Log("orders")
+	require.Equal(t, os.ErrClosed, err)
+
+	m, err = NewManager(dir, Config{})
+	require.NoError(t, err)
+	defer m.Close()
+
+	orders, err = m.Open("orders")
+	require.NoError(t, err)
+	record, err := orders.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, []byte("order"), record.Value)
+
+	require.NoError(t, m.Delete("payments"))
+	require.Equal(t, ErrUnknownTopic{Topic: "payments"}, m.Delete("payments"))
+	topics, err = m.Topics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"orders"}, topics)
+}
+
+// TestManagerCreateFailure tests that a topic whose partitions can't all be
+// created is removed rather than left with some of them.
+func TestManagerCreateFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager-create-failure-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewManager(dir, Config{})
+	require.NoError(t, err)
+	defer m.Close()
+
+	// another log holding the last partition's directory fails its creation
+	held := &Log{Dir: path.Join(dir, "orders", "2")}
+	require.NoError(t, os.MkdirAll(held.Dir, 0755))
+	require.NoError(t, held.lock())
+
+	_, err = m.create("orders", 3)
+	require.Equal(t, ErrDirLocked{Dir: held.Dir}, err)
+	require.NoError(t, held.unlock())
+
+	_, err = os.Stat(path.Join(dir, "orders"))
+	require.True(t, os.IsNotExist(err))
+	_, err = m.Topic("orders")
+	require.Equal(t, ErrUnknownTopic{Topic: "orders"}, err)
+
+	orders, err := m.CreatePartitioned("orders", 3)
+	require.NoError(t, err)
+	require.Equal(t, 3, orders.Partitions())
+}
+
+func TestManagerTiering(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manager-tiering-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	blobs, err := NewDirBlobStore(path.Join(dir, "blobs"))
+	require.NoError(t, err)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	c.Tiering.Store = blobs
+	m, err := NewManager(path.Join(dir, "topics"), c)
+	require.NoError(t, err)
+	defer m.Close()
+
+	// both topics offload segments with the same base offsets
+	for _, topic := range []string{"a", "b"} {
+		log, err := m.Log(topic)
+		require.NoError(t, err)
+		for i := 0; i < 10; i++ {
+			_, err = log.Append(&api.Record{Value: []byte(topic)})
+			require.NoError(t, err)
+		}
+		require.NoError(t, log.Offload())
+	}
+
+	for _, topic := range []string{"a", "b"} {
+		log, err := m.Open(topic)
+		require.NoError(t, err)
+		record, err := log.Read(0)
+		require.NoError(t, err)
+		require.Equal(t, []byte(topic), record.Value)
+	}
+
+	require.NoError(t, m.Delete("a"))
+	names, err := blobs.List()
+	require.NoError(t, err)
+	require.NotEmpty(t, names)
+	for _, name := range names {
+		require.Equal(t, "b", path.Dir(name))
+	}
+}
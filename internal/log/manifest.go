@@ -0,0 +1,250 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// manifestFile lists the log's segments, in the log's directory.
+	manifestFile = "manifest.json"
+
+	// manifestVersion is the version of the manifest's own format.
+	manifestVersion = 2
+	// manifestVersionRemote is the first version listing the segments
+	// offloaded to the blob store; before it, they were found by listing
+	// the blob store.
+	manifestVersionRemote = 2
+)
+
+// manifest records the log's on-disk format and its live segments. It's
+// rewritten whenever segments are added or removed: after a new segment's
+// files are created, and before a removed segment's files are deleted, so
+// at startup every listed segment must have its store, and a store that
+// isn't listed was either rolled or removed just before a crash.
+type manifest struct {
+	// Version is the manifest's format version and StoreVersion the
+	// version new stores are written in.
+	Version      int    `json:"version"`
+	StoreVersion uint32 `json:"store_version"`
+	// Created is when the log was created, or first opened with a
+	// manifest, and Config what it was opened with then; neither changes
+	// afterwards.
+	Created time.Time      `json:"created"`
+	Config  manifestConfig `json:"config"`
+	// Segments are the base offsets of the log's segments, in order.
+	Segments []uint64 `json:"segments"`
+	// Remote are the base offsets of the segments offloaded to the blob
+	// store, in order. Blobs of segments it doesn't list were uploaded, or
+	// were being deleted, when the process died, and are ignored.
+	Remote []uint64 `json:"remote,omitempty"`
+	// Migrations are the store format upgrades Log.Migrate made, in the
+	// order they were made.
+	Migrations []manifestMigration `json:"migrations,omitempty"`
+}
+
+// manifestMigration records segments rewritten from one store format
+// version to the next.
+type manifestMigration struct {
+	From     uint32    `json:"from"`
+	To       uint32    `json:"to"`
+	Segments int       `json:"segments"`
+	Finished time.Time `json:"finished"`
+}
+
+// manifestConfig is the configuration a log was created with.
+type manifestConfig struct {
+	MaxStoreBytes        uint64 `json:"max_store_bytes"`
+	MaxIndexBytes        uint64 `json:"max_index_bytes"`
+	InitialOffset        uint64 `json:"initial_offset"`
+	IndexIntervalRecords uint64 `json:"index_interval_records,omitempty"`
+	IndexIntervalBytes   uint64 `json:"index_interval_bytes,omitempty"`
+	Codec                uint8  `json:"codec,omitempty"`
+	Encrypted            bool   `json:"encrypted,omitempty"`
+}
+
+// newManifest returns the manifest of a log being created with conf.
+func newManifest(conf Config) *manifest {
+	m := &manifest{
+		Version:      manifestVersion,
+		StoreVersion: storeVersion,
+		Created:      time.Now().UTC(),
+		Config: manifestConfig{
+			MaxStoreBytes:        conf.Segment.MaxStoreBytes,
+			MaxIndexBytes:        conf.Segment.MaxIndexBytes,
+			InitialOffset:        conf.Segment.InitialOffset,
+			IndexIntervalRecords: conf.Segment.IndexIntervalRecords,
+			IndexIntervalBytes:   conf.Segment.IndexIntervalBytes,
+			Encrypted:            conf.Encryption != nil,
+		},
+	}
+	if conf.Compression != nil {
+		m.Config.Codec = conf.Compression.ID()
+	}
+	return m
+}
+
+// loadManifest reads the manifest in dir; it returns nil if there's none,
+// which is the case for logs written before manifests were.
+func loadManifest(dir string) (*manifest, error) {
+	p, err := ioutil.ReadFile(path.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	if err = json.Unmarshal(p, m); err != nil {
+		return nil, fmt.Errorf("%s: %w", path.Join(dir, manifestFile), err)
+	}
+	if m.Version > manifestVersion || m.StoreVersion > storeVersion {
+		return nil, ErrManifestVersion{Dir: dir, Version: m.Version, StoreVersion: m.StoreVersion}
+	}
+	return m, nil
+}
+
+// saveManifest writes the log's current segments to its manifest, and its
+// offloaded ones when it has a blob store; without one, the offloaded
+// segments listed are kept for when it has one again. The manifest is
+// written to a new file that's renamed over the old one, so a crash leaves
+// one or the other. The caller must hold the write lock.
+func (log *Log) saveManifest() error {
+	if log.Config.ReadOnly {
+		return nil
+	}
+
+	log.manifest.Segments = make([]uint64, len(log.segments))
+	for i, segment := range log.segments {
+		log.manifest.Segments[i] = segment.baseOffset
+	}
+
+	if log.Config.Tiering.Store != nil {
+		log.remoteMutex.Lock()
+		log.manifest.Remote = make([]uint64, len(log.remote))
+		for i, remote := range log.remote {
+			log.manifest.Remote[i] = remote.baseOffset
+		}
+		log.remoteMutex.Unlock()
+		log.manifest.Version = manifestVersion
+	}
+
+	p, err := json.MarshalIndent(log.manifest, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err = writeFile(path.Join(log.Dir, manifestFile), bytes.NewReader(p)); err != nil {
+		return err
+	}
+	return syncDir(log.Dir)
+}
+
+// removeSegments saves the manifest without the removed segments and then
+// removes their files, so a crash in between leaves files the next setup
+// knows to remove. The caller must hold the write lock and have taken the
+// segments out of log.segments.
+func (log *Log) removeSegments(removed ...*segment) error {
+	if err := log.saveManifest(); err != nil {
+		return err
+	}
+	for _, segment := range removed {
+		if err := segment.Remove(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// segmentBases returns the base offsets of the log's segments. With a
+// manifest, they're the segments it lists, plus a segment rolled after the
+// last one just before a crash kept it from being listed; the files of
+// segments removed just before a crash are deleted. Without one, they're
+// the segments with a store in the directory. A file the log doesn't know
+// is an ErrUnknownFile, and a listed segment without a store an
+// ErrMissingSegment.
+func (log *Log) segmentBases() ([]uint64, error) {
+	files, err := ioutil.ReadDir(log.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stores := make(map[uint64]bool)
+	segmentFiles := make(map[uint64][]string)
+	for _, file := range files {
+		name := file.Name()
+		switch {
+		case name == lockFile, name == consumersFile, name == manifestFile,
+			name == remoteDir && file.IsDir(), strings.HasSuffix(name, ".tmp"),
+			strings.HasSuffix(name, cleanedExt):
+			continue
+		}
+
+		ext := path.Ext(name)
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		known := ext == ".store" || ext == ".index" || ext == ".timeindex"
+		if err != nil || !known || file.IsDir() {
+			return nil, ErrUnknownFile{Dir: log.Dir, Name: name}
+		}
+
+		segmentFiles[base] = append(segmentFiles[base], name)
+		if ext == ".store" {
+			stores[base] = true
+		}
+	}
+
+	var bases []uint64
+	if log.manifest == nil {
+		for base := range stores {
+			bases = append(bases, base)
+		}
+		sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+		return bases, nil
+	}
+
+	bases = append(bases, log.manifest.Segments...)
+	listed := make(map[uint64]bool)
+	for _, base := range bases {
+		if !stores[base] {
+			return nil, ErrMissingSegment{Dir: log.Dir, BaseOffset: base}
+		}
+		listed[base] = true
+	}
+
+	var last uint64
+	if len(bases) > 0 {
+		last = bases[len(bases)-1]
+	}
+
+	var leftovers []uint64
+	for base := range segmentFiles {
+		switch {
+		case listed[base]:
+		case stores[base] && (len(bases) == 0 || base > last):
+			bases = append(bases, base)
+		default:
+			leftovers = append(leftovers, base)
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i] < bases[j] })
+
+	if log.Config.ReadOnly {
+		return bases, nil
+	}
+	for _, base := range leftovers {
+		for _, name := range segmentFiles[base] {
+			if err = os.Remove(path.Join(log.Dir, name)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return bases, nil
+}
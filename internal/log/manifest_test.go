@@ -0,0 +1,102 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "manifest-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 128
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	listed := func() []uint64 {
+		m, err := loadManifest(dir)
+		require.NoError(t, err)
+		require.Equal(t, manifestVersion, m.Version)
+		require.Equal(t, storeVersion, m.StoreVersion)
+		return m.Segments
+	}
+	bases := func(log *Log) []uint64 {
+		var bases []uint64
+		for _, segment := range log.segments {
+			bases = append(bases, segment.baseOffset)
+		}
+		return bases
+	}
+	require.Equal(t, []uint64{0}, listed())
+
+	// rolling and truncating update the manifest
+	for i := 0; i < 20; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.True(t, len(log.segments) > 4)
+	require.Equal(t, bases(log), listed())
+
+	require.NoError(t, log.Truncate(log.segments[0].nextOffset-1))
+	require.Equal(t, bases(log), listed())
+	require.NoError(t, log.Close())
+
+	rewrite := func(fn func(m *manifest)) {
+		m, err := loadManifest(dir)
+		require.NoError(t, err)
+		fn(m)
+		p, err := json.Marshal(m)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, manifestFile), p, 0644))
+	}
+
+	// a crash after the manifest dropped a segment leaves its files, which are removed
+	var removed, rolled uint64
+	rewrite(func(m *manifest) {
+		removed = m.Segments[0]
+		m.Segments = m.Segments[1:]
+	})
+	// and a crash before it listed a new segment leaves one that's kept
+	rewrite(func(m *manifest) {
+		rolled = m.Segments[len(m.Segments)-1]
+		m.Segments = m.Segments[:len(m.Segments)-1]
+	})
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, bases(log), listed())
+	require.NotContains(t, bases(log), removed)
+	require.Contains(t, bases(log), rolled)
+	_, err = os.Stat(path.Join(dir, fmt.Sprintf("%d.store", removed)))
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, log.Close())
+
+	// files that aren't the log's are reported rather than guessed at
+	for _, name := range []string{"notes.txt", "abc.store", "12.log"} {
+		require.NoError(t, ioutil.WriteFile(path.Join(dir, name), nil, 0644))
+		_, err = NewLog(dir, c)
+		require.Equal(t, ErrUnknownFile{Dir: dir, Name: name}, err)
+		require.NoError(t, os.Remove(path.Join(dir, name)))
+	}
+
+	rewrite(func(m *manifest) {
+		m.Segments = append([]uint64{removed}, m.Segments...)
+	})
+	_, err = NewLog(dir, c)
+	require.Equal(t, ErrMissingSegment{Dir: dir, BaseOffset: removed}, err)
+
+	rewrite(func(m *manifest) {
+		m.Segments = m.Segments[1:]
+		m.Version = manifestVersion + 1
+	})
+	_, err = NewLog(dir, c)
+	require.Equal(t, ErrManifestVersion{Dir: dir, Version: manifestVersion + 1, StoreVersion: storeVersion}, err)
+}
@@ -0,0 +1,219 @@
+package log
+
+import (
+	"bytes"
+	"crypto/sha256"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"google.golang.org/protobuf/proto"
+	"hash"
+	"path"
+	"time"
+)
+
+// SegmentMigration describes a segment rewritten from one store format
+// version to the next.
+type SegmentMigration struct {
+	BaseOffset uint64
+	From, To   uint32
+	// Records counts the records rewritten.
+	Records uint64
+	// BytesBefore and BytesAfter are the size of the segment's store
+	// before and after.
+	BytesBefore, BytesAfter uint64
+}
+
+// Migrate upgrades the log's sealed segments written in older store formats
+// to the current one, a segment and a version at a time: a version N store
+// is rewritten in version N+1, with new indexes, until it's current. Each
+// rewrite is written next to the segment's files like a compaction's, read
+// back and checked against the original, and only then swapped in, so the
+// original stays in place until its copy is verified. Migrating is
+// resumable: a crash leaves either the original or the verified copy, which
+// setup finishes swapping in, and the segments already upgraded are skipped
+// when Migrate runs again. It returns what it rewrote, in order.
+//
+// The active segment is never migrated; setup rolls a new one when it's
+// written in an older format and has records, so it's sealed by the time
+// Migrate runs. Offloaded segments keep their format.
+func (log *Log) Migrate() ([]SegmentMigration, error) {
+	if err := log.writable(); err != nil {
+		return nil, err
+	}
+
+	// compaction and offloading mustn't swap a segment while it's rewritten
+	log.compactMutex.Lock()
+	defer log.compactMutex.Unlock()
+
+	log.mutex.RLock()
+	sealed := append([]*segment(nil), log.segments[:len(log.segments)-1]...)
+	log.mutex.RUnlock()
+
+	var migrations []SegmentMigration
+	for _, segment := range sealed {
+		for segment != nil && segment.store.version < storeVersion {
+			var migration SegmentMigration
+			var err error
+			segment, migration, err = log.migrateSegment(segment)
+			if err != nil {
+				if len(migrations) > 0 {
+					log.recordMigrations(migrations)
+				}
+				return migrations, err
+			}
+			if segment != nil {
+				migrations = append(migrations, migration)
+			}
+		}
+	}
+
+	if len(migrations) == 0 {
+		return nil, nil
+	}
+	return migrations, log.recordMigrations(migrations)
+}
+
+// migrateSegment rewrites a sealed segment in the next store format version
+// and swaps it in for the original. It returns the rewritten segment, or nil
+// if the segment was removed from the log since it was picked. Like
+// compaction, it rewrites and verifies without the log's lock, which is
+// only taken to swap the segments.
+func (log *Log) migrateSegment(old *segment) (*segment, SegmentMigration, error) {
+	migration := SegmentMigration{
+		BaseOffset:  old.baseOffset,
+		From:        old.store.version,
+		To:          old.store.version + 1,
+		BytesBefore: old.store.size,
+	}
+
+	header := migration.To
+	if old.store.compacted {
+		header |= storeFlagCompacted
+	}
+
+	if !log.hasSegment(old) {
+		return nil, migration, nil
+	}
+
+	migrated, err := newCleanedSegment(log.Dir, old, header, log.Config)
+	if err != nil {
+		return nil, migration, err
+	}
+
+	digest := sha256.New()
+	err = old.scan(func(record *api.Record) error {
+		migration.Records++
+		if err := digestRecord(digest, record); err != nil {
+			return err
+		}
+		return migrated.write(record)
+	})
+	if err == nil {
+		err = migrated.sync()
+	}
+	if err == nil {
+		err = verifyMigrated(migrated, migration, digest.Sum(nil))
+	}
+	migration.BytesAfter = migrated.store.size
+	if closeErr := migrated.Close(); err == nil {
+		err = closeErr
+	}
+
+	// a segment removed while it was rewritten fails the scan
+	if err != nil && !log.hasSegment(old) {
+		return nil, migration, removeCleaned(log.Dir, old.baseOffset)
+	}
+	if err != nil {
+		if removeErr := removeCleaned(log.Dir, old.baseOffset); err == nil {
+			err = removeErr
+		}
+		return nil, migration, err
+	}
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	i := log.segmentIndex(old)
+	if i < 0 {
+		return nil, migration, removeCleaned(log.Dir, old.baseOffset)
+	}
+	if err = log.swapCleaned(i, old); err != nil {
+		return nil, migration, err
+	}
+	return log.segments[i], migration, nil
+}
+
+// verifyMigrated checks that a rewritten segment holds the same records as
+// the original, whose digest is given, and that its index finds each one.
+func verifyMigrated(migrated *segment, migration SegmentMigration, sum []byte) error {
+	mismatch := ErrMigrationMismatch{
+		Dir:        path.Dir(migrated.store.Name()),
+		BaseOffset: migration.BaseOffset,
+		Version:    migration.To,
+	}
+	if migrated.store.version != migration.To {
+		return mismatch
+	}
+
+	var records uint64
+	digest := sha256.New()
+	err := migrated.scan(func(record *api.Record) error {
+		records++
+		if err := digestRecord(digest, record); err != nil {
+			return err
+		}
+		read, err := migrated.Read(record.Offset)
+		if err != nil {
+			return err
+		}
+		if !proto.Equal(read, record) {
+			return mismatch
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if records != migration.Records || !bytes.Equal(digest.Sum(nil), sum) {
+		return mismatch
+	}
+	return nil
+}
+
+// digestRecord adds a record to a digest of a segment's records.
+func digestRecord(digest hash.Hash, record *api.Record) error {
+	p, err := proto.MarshalOptions{Deterministic: true}.Marshal(record)
+	if err != nil {
+		return err
+	}
+	var n [lenWidth]byte
+	fileEncoding.PutUint64(n[:], uint64(len(p)))
+	digest.Write(n[:])
+	digest.Write(p)
+	return nil
+}
+
+// recordMigrations notes in the manifest how many segments each step
+// rewrote.
+func (log *Log) recordMigrations(migrations []SegmentMigration) error {
+	segments := make(map[uint32]int)
+	for _, migration := range migrations {
+		segments[migration.From]++
+	}
+
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	finished := time.Now().UTC()
+	for from := storeVersionLegacy; from < storeVersion; from++ {
+		if segments[from] == 0 {
+			continue
+		}
+		log.manifest.Migrations = append(log.manifest.Migrations, manifestMigration{
+			From:     from,
+			To:       from + 1,
+			Segments: segments[from],
+			Finished: finished,
+		})
+	}
+	return log.saveManifest()
+}
@@ -0,0 +1,134 @@
+package log
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/require"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"google.golang.org/protobuf/proto"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+// TestMigrate tests that segments written in older store formats are
+// rewritten a version at a time until they're current, that the rewrite
+// survives an interrupted run and that Config.Migrate runs it at startup.
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// two legacy segments, without indexes, which setup rebuilds
+	for _, base := range []uint64{0, 2} {
+		storeFile, err := os.Create(path.Join(dir, fmt.Sprintf("%d.store", base)))
+		require.NoError(t, err)
+		for off := base; off < base+2; off++ {
+			p, err := proto.Marshal(&api.Record{Value: []byte("hello world"), Offset: off})
+			require.NoError(t, err)
+
+			frame := make([]byte, lenWidth)
+			fileEncoding.PutUint64(frame, uint64(len(p)))
+			_, err = storeFile.Write(append(frame, p...))
+			require.NoError(t, err)
+		}
+		require.NoError(t, storeFile.Close())
+	}
+
+	// a copy left behind by a run that crashed before swapping it in
+	require.NoError(t, ioutil.WriteFile(cleanedName(dir, 0, ".store"), []byte("garbage"), 0644))
+
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(log.segments))
+
+	off, err := log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+
+	// appends and reads go on while segments are rewritten
+	appended := make(chan error, 1)
+	go func() {
+		for i := 0; i < 20; i++ {
+			if _, err := log.Append(&api.Record{Value: []byte("hello world")}); err != nil {
+				appended <- err
+				return
+			}
+			if _, err := log.Read(uint64(i % 4)); err != nil {
+				appended <- err
+				return
+			}
+		}
+		appended <- nil
+	}()
+
+	migrations, err := log.Migrate()
+	require.NoError(t, err)
+	require.NoError(t, <-appended)
+	require.Equal(t, 4, len(migrations))
+	for i, base := range []uint64{0, 0, 2, 2} {
+		require.Equal(t, base, migrations[i].BaseOffset)
+		require.Equal(t, uint32(i%2), migrations[i].From)
+		require.Equal(t, uint32(i%2+1), migrations[i].To)
+		require.Equal(t, uint64(2), migrations[i].Records)
+		require.True(t, migrations[i].BytesAfter > migrations[i].BytesBefore)
+	}
+	for _, segment := range log.segments {
+		require.Equal(t, storeVersion, segment.store.version)
+	}
+
+	for i := uint64(0); i < 25; i++ {
+		read, err := log.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, i, read.Offset)
+		require.Equal(t, []byte("hello world"), read.Value)
+	}
+
+	require.Equal(t, 2, len(log.manifest.Migrations))
+	require.Equal(t, manifestMigration{
+		From:     storeVersionLegacy,
+		To:       storeVersionChecksum,
+		Segments: 2,
+		Finished: log.manifest.Migrations[0].Finished,
+	}, log.manifest.Migrations[0])
+	require.Equal(t, storeVersionAttributes, log.manifest.Migrations[1].To)
+
+	// everything is current, so there's nothing left to do
+	migrations, err = log.Migrate()
+	require.NoError(t, err)
+	require.Nil(t, migrations)
+	require.NoError(t, log.Close())
+
+	_, err = os.Stat(cleanedName(dir, 0, ".store"))
+	require.True(t, os.IsNotExist(err))
+
+	// a segment written in the checksum format is upgraded at startup
+	storeFile, err := os.OpenFile(path.Join(dir, "25.store"), os.O_RDWR|os.O_CREATE, 0644)
+	require.NoError(t, err)
+	require.NoError(t, writeStoreHeader(storeFile, storeVersionChecksum))
+	require.NoError(t, storeFile.Close())
+	checksumStore, err := os.OpenFile(path.Join(dir, "25.store"), os.O_RDWR|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	s, err := newStore(checksumStore, c)
+	require.NoError(t, err)
+	p, err := proto.Marshal(&api.Record{Value: []byte("checksummed"), Offset: 25})
+	require.NoError(t, err)
+	_, _, err = s.Append(p)
+	require.NoError(t, err)
+	require.NoError(t, s.Close())
+
+	c.Migrate = true
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for _, segment := range log.segments[:len(log.segments)-1] {
+		require.Equal(t, storeVersion, segment.store.version)
+	}
+	read, err := log.Read(25)
+	require.NoError(t, err)
+	require.Equal(t, []byte("checksummed"), read.Value)
+	require.Equal(t, 3, len(log.manifest.Migrations))
+}
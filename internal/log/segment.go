@@ -4,20 +4,33 @@ import (
 	"fmt"
 	api "github.com/xhantimda/commitlog/api/v1"
 	"google.golang.org/protobuf/proto"
+	"io"
+	"math"
 	"os"
 	"path"
 )
 
+// timeIndexBytes is how big a time index file starts out, room for 64
+// entries. Unlike the offset index, it isn't sized by the segment's max
+// index size: it doubles as it fills, and a segment never rolls because of
+// it.
+const timeIndexBytes = 768
+
 func newSegment(dir string, baseOffset uint64, conf Config) (*segment, error) {
 	seg := &segment{
 		baseOffset: baseOffset,
 		config:     conf,
 	}
 
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if conf.ReadOnly {
+		flag = os.O_RDONLY
+	}
+
 	var err error
 	storeFile, err := os.OpenFile(
 		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		flag,
 		0644,
 	)
 
@@ -25,76 +38,390 @@ func newSegment(dir string, baseOffset uint64, conf Config) (*segment, error) {
 		return nil, err
 	}
 
-	if seg.store, err = newStore(storeFile); err != nil {
+	if seg.store, err = newStore(storeFile, conf); err != nil {
+		storeFile.Close()
 		return nil, err
 	}
 
-	indexFile, err := os.OpenFile(
-		path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")),
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
-		0644,
-	)
-	if err != nil {
+	if seg.index, err = openIndex(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")), flag, conf); err != nil {
+		seg.store.Close()
 		return nil, err
 	}
 
-	if seg.index, err = newIndex(indexFile, conf); err != nil {
+	if seg.timeIndex, err = openIndex(path.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".timeindex")), flag, timeIndexConfig(conf)); err != nil {
+		seg.index.Close()
+		seg.store.Close()
 		return nil, err
 	}
 
-	// if index is empty, nextOffset = baseOffset
-	if off, _, err := seg.index.Read(-1); err != nil {
-		seg.nextOffset = baseOffset
-	} else {
-		seg.nextOffset = baseOffset + uint64(off) + 1
+	if seg.recovery, err = seg.recover(); err != nil {
+		seg.Close()
+		return nil, err
 	}
 	return seg, nil
 }
 
+// openIndex opens the index file with the given name. A read-only segment
+// can't create a missing index, so it gets an empty one that isn't backed
+// by a file and finds records by scanning the store.
+func openIndex(name string, flag int, conf Config) (*index, error) {
+	file, err := os.OpenFile(name, flag, 0644)
+	if os.IsNotExist(err) && conf.ReadOnly {
+		return &index{readOnly: true}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := newIndex(file, conf)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return index, nil
+}
+
+// recover brings the index and store back in line after the segment was
+// last closed uncleanly: it drops index entries that point at missing or
+// damaged records, indexes complete records written past the index's last
+// entry and cuts off a partially written record at the store's tail.
+// Scanning from the last entry also gives the segment its next offset.
+func (seg *segment) recover() (SegmentRecovery, error) {
+	report := SegmentRecovery{BaseOffset: seg.baseOffset}
+
+	entries := seg.index.validEntries(seg.store.firstPosition(), seg.store.size)
+
+	// the last entries may have been written before their records reached
+	// the store; checking the frame is enough, the record needn't be decoded
+	var rel uint64
+	next := seg.store.firstPosition()
+	for entries > 0 {
+		off, pos, err := seg.index.Read(int64(entries - 1))
+		if err != nil {
+			return report, err
+		}
+		if _, end, err := seg.store.readBody(pos); err == nil {
+			rel, next = uint64(off)+1, end
+			break
+		} else if !seg.store.isTorn(pos, err) {
+			return report, seg.corrupt(uint64(off), err)
+		}
+		entries--
+		report.DroppedEntries++
+	}
+	seg.index.truncate(entries)
+
+	// the time index pairs offsets with timestamps, rather than positions;
+	// entries for the records about to be scanned are written again
+	timeEntries := seg.timeIndex.validEntries(1, math.MaxUint64)
+	if entries == 0 {
+		timeEntries = 0
+	}
+	for ; timeEntries > 0; timeEntries-- {
+		timeRel, timestamp, err := seg.timeIndex.Read(int64(timeEntries - 1))
+		if err != nil {
+			return report, err
+		}
+		if uint64(timeRel) < rel {
+			seg.lastTimestamp = int64(timestamp)
+			break
+		}
+	}
+	seg.timeIndex.truncate(timeEntries)
+
+	// scan the records after the last indexed one
+	return report, seg.indexFrom(rel, next, &report)
+}
+
+// rebuildIndex throws away the segment's index and regenerates it from
+// the records in the store.
+func (seg *segment) rebuildIndex() (SegmentRecovery, error) {
+	report := SegmentRecovery{BaseOffset: seg.baseOffset}
+
+	if err := seg.store.flush(); err != nil {
+		return report, err
+	}
+	seg.index.truncate(0)
+	seg.timeIndex.truncate(0)
+	seg.lastTimestamp = 0
+
+	return report, seg.indexFrom(0, seg.store.firstPosition(), &report)
+}
+
+// indexFrom scans the records in the store from position next onwards,
+// starting with the one at relative offset rel, adds the index entries
+// missing for them and sets the segment's next offset past the last one.
+// A partially written record at the store's tail is cut off, but a damaged
+// record with records after it is returned as an error, and nothing is
+// cut: the records after it are still good. Every record
+// must carry the offset its place in the segment implies, except in a
+// compacted store, where offsets only have to grow.
+func (seg *segment) indexFrom(rel, next uint64, report *SegmentRecovery) error {
+	for next < seg.store.size {
+		p, end, err := seg.store.readFrame(next)
+		if seg.store.isTorn(next, err) {
+			break
+		}
+		if err != nil {
+			return seg.corrupt(rel, err)
+		}
+
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		want := seg.baseOffset + rel
+		gap := record.Offset != want
+		if gap && !(seg.store.compacted && record.Offset > want) {
+			return ErrOffsetMismatch{
+				BaseOffset: seg.baseOffset,
+				Position:   next,
+				Want:       want,
+				Got:        record.Offset,
+			}
+		}
+		rel = record.Offset - seg.baseOffset
+
+		// a read-only index can't be written, reads scan the store from its last entry
+		if !seg.config.ReadOnly && (gap || seg.shouldIndex(uint32(rel), next)) {
+			if err = writeEntry(seg.index, uint32(rel), next); err != nil {
+				return err
+			}
+			report.IndexedRecords++
+		}
+		if !seg.config.ReadOnly && seg.shouldTimeIndex(uint32(rel), record.Timestamp) {
+			if err = writeEntry(seg.timeIndex, uint32(rel), uint64(record.Timestamp)); err != nil {
+				return err
+			}
+		}
+		if record.Timestamp > seg.lastTimestamp {
+			seg.lastTimestamp = record.Timestamp
+		}
+		rel++
+		next = end
+	}
+
+	if next < seg.store.size {
+		report.TruncatedBytes = seg.store.size - next
+		if seg.config.ReadOnly {
+			seg.store.size = next
+		} else if err := seg.store.truncate(next); err != nil {
+			return err
+		}
+	}
+
+	seg.nextOffset = seg.baseOffset + rel
+	return nil
+}
+
+// batchTail returns the position of the first of the records at the end of
+// the segment flagged as followed by more of their batch, or the store's
+// size if the last record isn't flagged. In the log's last segments such a
+// run is a batch cut short by a crash. The scan starts from the last index
+// entry and only goes back to the start of the store when the run does.
+func (seg *segment) batchTail() (uint64, error) {
+	first := seg.store.firstPosition()
+	if seg.store.version < storeVersionAttributes {
+		return seg.store.size, nil
+	}
+
+	from := first
+	if _, pos, err := seg.index.Read(-1); err == nil {
+		from = pos
+	}
+	start, err := seg.store.batchRun(from)
+	if err != nil || start != from || from == first {
+		return start, err
+	}
+	return seg.store.batchRun(first)
+}
+
+// truncateTo cuts the segment's store at position and brings its indexes
+// and next offset back in line with the records left.
+func (seg *segment) truncateTo(position uint64) error {
+	if err := seg.store.unseal(); err != nil {
+		return err
+	}
+	if err := seg.store.truncate(position); err != nil {
+		return err
+	}
+
+	seg.lastTimestamp = 0
+	_, err := seg.recover()
+	return err
+}
+
+// timeIndexConfig returns the config a segment's time index is opened with.
+func timeIndexConfig(conf Config) Config {
+	conf.Segment.MaxIndexBytes = timeIndexBytes
+	return conf
+}
+
+// writeEntry writes an entry the store's records need to the index, growing
+// the index when they need more room than the segment's max index size:
+// a store indexed under a smaller max size, or with a denser index, than
+// it was written with still has every record indexed, rather than being
+// cut down to what fits.
+func writeEntry(index *index, off uint32, pos uint64) error {
+	err := index.Write(off, pos)
+	if err != io.EOF {
+		return err
+	}
+	if err = index.grow(); err != nil {
+		return err
+	}
+	return index.Write(off, pos)
+}
+
+// shouldIndex reports whether the record at the relative offset and store
+// position needs an index entry. Every record gets one unless the segment
+// keeps a sparse index, which only adds an entry once enough records or
+// bytes follow the last one.
+func (seg *segment) shouldIndex(rel uint32, pos uint64) bool {
+	lastRel, lastPos, err := seg.index.Read(-1)
+	if err != nil {
+		return true
+	}
+	if rel <= lastRel {
+		return false
+	}
+
+	everyRecords := seg.config.Segment.IndexIntervalRecords
+	everyBytes := seg.config.Segment.IndexIntervalBytes
+	if everyRecords == 0 && everyBytes == 0 {
+		return true
+	}
+	return (everyRecords > 0 && uint64(rel-lastRel) >= everyRecords) ||
+		(everyBytes > 0 && pos-lastPos >= everyBytes)
+}
+
+// corrupt fills in which record a corrupt frame holds, from its offset
+// relative to the segment's base; other errors are returned as they are.
+func (seg *segment) corrupt(rel uint64, err error) error {
+	if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+		corrupt.Offset = seg.baseOffset + rel
+		corrupt.BaseOffset = seg.baseOffset
+		return corrupt
+	}
+	return err
+}
+
+// shouldTimeIndex reports whether the record at the relative offset needs a
+// time index entry: the first record stamped with each new timestamp gets
+// one, so every record between two entries carries the earlier entry's
+// timestamp. Records without a timestamp are never indexed.
+func (seg *segment) shouldTimeIndex(rel uint32, timestamp int64) bool {
+	if timestamp <= 0 {
+		return false
+	}
+	lastRel, lastTimestamp, err := seg.timeIndex.Read(-1)
+	if err != nil {
+		return true
+	}
+	return rel > lastRel && uint64(timestamp) > lastTimestamp
+}
+
+// offsetForTime returns the offset of the first record in the segment with
+// a timestamp at or after the given one, if there's one.
+func (seg *segment) offsetForTime(timestamp int64) (uint64, bool) {
+	rel, _, err := seg.timeIndex.searchPos(uint64(timestamp))
+	if err != nil {
+		return 0, false
+	}
+	return seg.baseOffset + uint64(rel), true
+}
+
 // Append writes the record to the segment and returns the newly appended
 // record’s offset.
 func (seg *segment) Append(record *api.Record) (offset uint64, err error) {
+	return seg.appendFrame(record, 0)
+}
+
+// appendFrame appends the record like Append, setting attributes in its
+// frame.
+func (seg *segment) appendFrame(record *api.Record, attributes uint8) (offset uint64, err error) {
 
 	cur := seg.nextOffset
 	record.Offset = cur
 
+	if err = seg.writeFrame(record, attributes); err != nil {
+		return 0, err
+	}
+
+	return cur, nil
+
+}
+
+// write appends the record to the segment at the offset it carries, which
+// can be past the segment's next offset when compaction removed the records
+// in between. A record after such a gap always gets an index entry, so the
+// records between two entries have contiguous offsets.
+func (seg *segment) write(record *api.Record) error {
+	return seg.writeFrame(record, 0)
+}
+
+// writeFrame writes the record like write, setting attributes in its frame.
+func (seg *segment) writeFrame(record *api.Record, attributes uint8) error {
+
 	p, err := proto.Marshal(record)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	// append the data to the store
-	_, pos, err := seg.store.Append(p)
+	_, pos, err := seg.store.appendFrame(p, attributes)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
 	// index offset are relative to the baseOffset
 	// subtract the segment's next offset from its baseOffset
-	off := uint32(cur - uint64(seg.baseOffset))
+	off := uint32(record.Offset - uint64(seg.baseOffset))
 
 	// add an entry to the index
-	err = seg.index.Write(off, pos)
-	if err != nil {
-		return 0, err
+	if record.Offset != seg.nextOffset || seg.shouldIndex(off, pos) {
+		// a full dense index fails the append, a sparse one grows
+		if seg.sparse() {
+			err = writeEntry(seg.index, off, pos)
+		} else {
+			err = seg.index.Write(off, pos)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	seg.nextOffset++
-	return cur, nil
+	if seg.shouldTimeIndex(off, record.Timestamp) {
+		err = writeEntry(seg.timeIndex, off, uint64(record.Timestamp))
+		if err != nil {
+			return err
+		}
+	}
+	if record.Timestamp > seg.lastTimestamp {
+		seg.lastTimestamp = record.Timestamp
+	}
 
+	seg.nextOffset = record.Offset + 1
+	return nil
 }
 
-// Read returns the record for the given offset
+// Read returns the record for the given offset or, if compaction removed
+// it, the first record after it. It returns io.EOF when no record in the
+// segment is at or after the offset.
 func (seg *segment) Read(off uint64) (*api.Record, error) {
 
-	// translate the absolute index into a relative offset
-	relOffset := int64(off - seg.baseOffset)
-	_, pos, err := seg.index.Read(relOffset)
+	pos, err := seg.locate(off)
 	if err != nil {
 		return nil, err
 	}
+
 	// use the record's position to retrieve the entry from the store
 	bytes, err := seg.store.Read(pos)
+	if corrupt, ok := err.(api.ErrCorruptRecord); ok {
+		corrupt.Offset = off
+		corrupt.BaseOffset = seg.baseOffset
+		return nil, corrupt
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -104,11 +431,95 @@ func (seg *segment) Read(off uint64) (*api.Record, error) {
 	return record, err
 }
 
+// locate returns the store position of the record for the given offset or,
+// if compaction removed it, of the first record after it. It returns io.EOF
+// when no record in the segment is at or after the offset.
+func (seg *segment) locate(off uint64) (uint64, error) {
+
+	// translate the absolute index into a relative offset
+	var relOffset uint32
+	if off > seg.baseOffset {
+		relOffset = uint32(off - seg.baseOffset)
+	}
+
+	// find the closest entry at or before the record, and skip the records
+	// between them when the index is sparse; a record removed by compaction
+	// leaves the skip at the next entry
+	entry, err := seg.index.search(relOffset)
+	if err == io.EOF {
+		// compaction removed the records before the first entry
+		entry = 0
+	}
+	entryOffset, pos, err := seg.index.Read(entry)
+	if err == io.EOF && seg.index.size == 0 {
+		// a read-only segment without an index scans its store from the start
+		entryOffset, pos = 0, seg.store.firstPosition()
+		if pos >= seg.store.size {
+			return 0, io.EOF
+		}
+	} else if err != nil {
+		return 0, err
+	}
+	if relOffset < entryOffset {
+		relOffset = entryOffset
+	}
+	limit := seg.store.size
+	if _, nextPos, err := seg.index.Read(entry + 1); err == nil {
+		limit = nextPos
+	}
+	return seg.store.seek(pos, relOffset-entryOffset, limit)
+}
+
+// scan calls fn with each record in the segment in order. The segment must
+// be sealed, so nothing is appended to it while it's read.
+func (seg *segment) scan(fn func(record *api.Record) error) error {
+	if err := seg.store.flush(); err != nil {
+		return err
+	}
+
+	for pos := seg.store.firstPosition(); pos < seg.store.size; {
+		p, next, err := seg.store.readFrame(pos)
+		if err != nil {
+			return err
+		}
+
+		record := &api.Record{}
+		if err = proto.Unmarshal(p, record); err != nil {
+			return err
+		}
+		if err = fn(record); err != nil {
+			return err
+		}
+		pos = next
+	}
+	return nil
+}
+
+// sync makes the segment's records durable. The store goes first so the
+// index never points at records that didn't make it to disk.
+func (seg *segment) sync() error {
+	if err := seg.store.sync(); err != nil {
+		return err
+	}
+	if err := seg.index.sync(); err != nil {
+		return err
+	}
+	return seg.timeIndex.sync()
+}
+
 // IsMaxed returns whether the segment has reached its max size,
-// either by writing too much to the store or the index
+// either by writing too much to the store or having no room for another index entry.
+// A sparse index grows past its max size instead, so only the store rolls the segment.
 func (seg *segment) IsMaxed() bool {
-	return seg.store.size >= seg.config.Segment.MaxStoreBytes ||
-		seg.index.size >= seg.config.Segment.MaxIndexBytes
+	if seg.store.size >= seg.config.Segment.MaxStoreBytes {
+		return true
+	}
+	return !seg.sparse() && seg.index.size+entWidth > seg.config.Segment.MaxIndexBytes
+}
+
+// sparse reports whether the segment keeps a sparse index.
+func (seg *segment) sparse() bool {
+	return seg.config.Segment.IndexIntervalRecords > 0 || seg.config.Segment.IndexIntervalBytes > 0
 }
 
 // Remove closes the segment and removes the index and store files.
@@ -119,6 +530,9 @@ func (seg *segment) Remove() error {
 	if err := os.Remove(seg.index.Name()); err != nil {
 		return err
 	}
+	if err := os.Remove(seg.timeIndex.Name()); err != nil {
+		return err
+	}
 	if err := os.Remove(seg.store.Name()); err != nil {
 		return err
 	}
@@ -127,9 +541,13 @@ func (seg *segment) Remove() error {
 
 // Close ensures that the store and index files are closed.
 func (seg *segment) Close() error {
+	seg.closed = true
 	if err := seg.index.Close(); err != nil {
 		return err
 	}
+	if err := seg.timeIndex.Close(); err != nil {
+		return err
+	}
 	if err := seg.store.Close(); err != nil {
 		return err
 	}
@@ -153,4 +571,32 @@ type segment struct {
 	baseOffset uint64
 	nextOffset uint64
 	config     Config
+	recovery   SegmentRecovery
+
+	// timeIndex maps timestamps, stored as positions, to the first record
+	// stamped with them; lastTimestamp is the latest record's timestamp.
+	timeIndex     *index
+	lastTimestamp int64
+
+	// closed is set once the segment is closed, which tells iterators
+	// reading it that it was removed or replaced
+	closed bool
+}
+
+// SegmentRecovery describes the repairs made to a segment when it was opened.
+type SegmentRecovery struct {
+	BaseOffset uint64
+	// DroppedEntries counts index entries that pointed at missing or damaged records.
+	DroppedEntries uint64
+	// IndexedRecords counts complete records found in the store past the index's last entry.
+	IndexedRecords uint64
+	// TruncatedBytes counts the bytes of a partially written record cut from the store's tail.
+	TruncatedBytes uint64
+	// DroppedRecords counts the records of a batch cut short by a crash, dropped from the log's tail.
+	DroppedRecords uint64
+}
+
+// Repaired reports whether anything had to be fixed.
+func (r SegmentRecovery) Repaired() bool {
+	return r.DroppedEntries > 0 || r.IndexedRecords > 0 || r.TruncatedBytes > 0 || r.DroppedRecords > 0
 }
@@ -0,0 +1,111 @@
+package log
+
+import (
+	"io"
+	"os"
+	"path"
+)
+
+// Snapshot is the log's store files as they were when it was taken. It
+// opens the files itself and only reads as far as they went then, so it
+// stays the same while the log is appended to, truncated or compacted.
+// Copying its files into an empty directory gives a log with its records;
+// indexes are rebuilt when that log is opened. Close it when done.
+type Snapshot struct {
+	files        []SnapshotFile
+	lowestOffset uint64
+	nextOffset   uint64
+	size         int64
+}
+
+// SnapshotFile is a segment's store file in a snapshot.
+type SnapshotFile struct {
+	// Name is the store file's name in the log's directory.
+	Name       string
+	BaseOffset uint64
+	Size       int64
+
+	file *os.File
+}
+
+// Reader returns a reader of the store file's contents in the snapshot.
+func (f SnapshotFile) Reader() io.Reader {
+	return io.NewSectionReader(f.file, 0, f.Size)
+}
+
+// Snapshot takes a snapshot of the log.
+func (log *Log) Snapshot() (*Snapshot, error) {
+	log.mutex.RLock()
+	defer log.mutex.RUnlock()
+
+	snapshot := &Snapshot{
+		lowestOffset: log.segments[0].baseOffset,
+		nextOffset:   log.activeSegment.nextOffset,
+	}
+
+	for _, segment := range log.segments {
+		// records still buffered have to be in the file to be read from it
+		if err := segment.store.flush(); err != nil {
+			snapshot.Close()
+			return nil, err
+		}
+
+		file, err := os.Open(segment.store.Name())
+		if err != nil {
+			snapshot.Close()
+			return nil, err
+		}
+
+		snapshot.files = append(snapshot.files, SnapshotFile{
+			Name:       path.Base(segment.store.Name()),
+			BaseOffset: segment.baseOffset,
+			Size:       int64(segment.store.size),
+			file:       file,
+		})
+		snapshot.size += int64(segment.store.size)
+	}
+
+	return snapshot, nil
+}
+
+// Files returns the snapshot's store files, in offset order.
+func (s *Snapshot) Files() []SnapshotFile {
+	return s.files
+}
+
+// Reader returns a reader of all the snapshot's store files one after the
+// other, like Log.Reader.
+func (s *Snapshot) Reader() io.Reader {
+	readers := make([]io.Reader, len(s.files))
+	for i, f := range s.files {
+		readers[i] = f.Reader()
+	}
+	return io.MultiReader(readers...)
+}
+
+// Size returns the total size of the snapshot's files.
+func (s *Snapshot) Size() int64 {
+	return s.size
+}
+
+// LowestOffset returns the offset the snapshot's records start from.
+func (s *Snapshot) LowestOffset() uint64 {
+	return s.lowestOffset
+}
+
+// NextOffset returns the offset after the snapshot's last record, so the
+// snapshot covers the offsets from LowestOffset up to NextOffset.
+func (s *Snapshot) NextOffset() uint64 {
+	return s.nextOffset
+}
+
+// Close closes the snapshot's files.
+func (s *Snapshot) Close() error {
+	var err error
+	for _, f := range s.files {
+		if closeErr := f.file.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -2,27 +2,83 @@ package log
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
+	"github.com/tysonmote/gommap"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"hash/crc32"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 var (
 	fileEncoding = binary.BigEndian
+	crcTable     = crc32.MakeTable(crc32.Castagnoli)
+	storeMagic   = []byte("CLOG")
 )
 
 const (
-	lenWidth = 8
+	lenWidth        = 8
+	crcWidth        = 4
+	headerWidth     = 8
+	attributesWidth = 1
+
+	// attributeBatchContinues is set in the attributes of every record of a
+	// batch but the last, so recovery can tell a batch cut short by a crash.
+	attributeBatchContinues = 0x20
+
+	// storeVersionLegacy stores have no header and frame every record as
+	// a length followed by the record bytes.
+	storeVersionLegacy uint32 = 0
+	// storeVersionChecksum stores start with a header and frame every
+	// record as a length, a CRC32C of the record bytes and the record bytes.
+	storeVersionChecksum uint32 = 1
+	// storeVersionAttributes stores frame every record like checksum
+	// stores, but the checksummed bytes start with a byte of attributes
+	// saying which codec compressed the rest.
+	storeVersionAttributes uint32 = 2
+
+	storeVersion = storeVersionAttributes
+
+	// the header's version is in its lower half, flags in its upper half
+	storeVersionMask uint32 = 0xffff
+	// storeFlagCompacted marks stores written by compaction, whose records
+	// can skip the offsets of records compaction removed.
+	storeFlagCompacted uint32 = 1 << 16
 )
 
 type store struct {
+	//flushed is how much of the store has been written through to the file,
+	//readers below it don't need the lock; it's first so atomic operations
+	//find it 64-bit aligned
+	flushed uint64
+
 	*os.File
 	mutex        sync.Mutex
 	memoryBuffer *bufio.Writer
 	size         uint64
+	version      uint32
+	compacted    bool
+	codec        Codec
+	keys         KeyProvider
+
+	//the ciphers for the keys records were encrypted with, by key ID
+	aeads sync.Map
+
+	//record bytes appended since the store was opened, before and after encoding
+	appendedBytes uint64
+	encodedBytes  uint64
+
+	//a sealed store is mapped into memory and read from the map; readers
+	//hold mapMutex's read lock while they copy from it, so it's never
+	//unmapped under them, even by readers that don't hold the log's lock
+	mapMutex  sync.RWMutex
+	memoryMap gommap.MMap
 }
 
-func newStore(file *os.File) (*store, error) {
+func newStore(file *os.File, config Config) (*store, error) {
 
 	// get the file information
 	fileInfo, err := os.Stat(file.Name())
@@ -35,14 +91,122 @@ func newStore(file *os.File) (*store, error) {
 	size := uint64(fileInfo.Size())
 
 	//create a new store with a new Writer
-	return &store{
+	store := &store{
 		File:         file,
 		size:         size,
+		flushed:      size,
 		memoryBuffer: bufio.NewWriter(file),
-	}, nil
+		codec:        config.Compression,
+		keys:         config.Encryption,
+	}
+
+	//new stores are written in the current format, existing ones keep theirs
+	if size == 0 && config.ReadOnly {
+		store.version = storeVersion
+		return store, nil
+	}
+
+	if size == 0 {
+		if err = writeStoreHeader(file, storeVersion); err != nil {
+			return nil, err
+		}
+		store.size = headerWidth
+		store.flushed = headerWidth
+		store.version = storeVersion
+		return store, nil
+	}
+
+	header, err := readStoreHeader(file, size)
+	if err != nil {
+		return nil, err
+	}
+
+	store.version = header & storeVersionMask
+	store.compacted = header&storeFlagCompacted != 0
+
+	//a newer format can frame records in ways this version can't read
+	if store.version > storeVersion {
+		return nil, ErrStoreVersion{Name: file.Name(), Version: store.version}
+	}
+
+	return store, nil
+}
+
+// writeStoreHeader marks an empty store file with the magic and the header:
+// the format version in its lower half and flags in its upper half.
+func writeStoreHeader(file *os.File, header uint32) error {
+	p := make([]byte, headerWidth)
+	copy(p, storeMagic)
+	fileEncoding.PutUint32(p[len(storeMagic):], header)
+
+	_, err := file.Write(p)
+	return err
+}
+
+// restart empties the store and starts it again in the current format. It's
+// for an active store written in an older format that holds no records yet,
+// which would otherwise take new records in its own format.
+func (store *store) restart() error {
+
+	store.mutex.Lock()
+
+	defer store.mutex.Unlock()
+
+	if err := store.flushBuffer(); err != nil {
+		return err
+	}
+
+	if err := store.File.Truncate(0); err != nil {
+		return err
+	}
+
+	if err := writeStoreHeader(store.File, storeVersion); err != nil {
+		return err
+	}
+
+	store.size = headerWidth
+	atomic.StoreUint64(&store.flushed, headerWidth)
+	store.version = storeVersion
+	store.compacted = false
+	return nil
+}
+
+// readStoreHeader returns the format version and flags of a non-empty store
+// file. Files without the magic header predate versioning and are legacy
+// stores; their first bytes are the length of the first record.
+func readStoreHeader(file *os.File, size uint64) (uint32, error) {
+	if size < headerWidth {
+		return storeVersionLegacy, nil
+	}
+
+	header := make([]byte, headerWidth)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return 0, err
+	}
+
+	if !bytes.Equal(header[:len(storeMagic)], storeMagic) {
+		return storeVersionLegacy, nil
+	}
+
+	return fileEncoding.Uint32(header[len(storeMagic):]), nil
+}
+
+// frameWidth returns the number of bytes that precede a record's data in the store.
+func (store *store) frameWidth() uint64 {
+	if store.version == storeVersionLegacy {
+		return lenWidth
+	}
+	return lenWidth + crcWidth
 }
 
 func (store *store) Append(bytes []byte) (totalBytes uint64, position uint64, error error) {
+	return store.appendFrame(bytes, 0)
+}
+
+// appendFrame appends bytes like Append, with the given attributes set in
+// the frame along with those saying how the bytes were encoded. Stores
+// written before frames carried attributes drop them.
+func (store *store) appendFrame(bytes []byte, attributes uint8) (totalBytes uint64, position uint64, error error) {
 
 	//obtain a lock on the store before performing any actions on it
 	store.mutex.Lock()
@@ -53,69 +217,387 @@ func (store *store) Append(bytes []byte) (totalBytes uint64, position uint64, er
 	//the position of the bytes to be appended is equal to the current size of the store
 	position = store.size
 
+	//compress the bytes if the store's format records how
+	body, err := store.encode(attributes, bytes)
+
+	if err != nil {
+		return 0, 0, err
+	}
+
 	//write the length of the bytes to store
-	err := binary.Write(store.memoryBuffer, fileEncoding, uint64(len(bytes)))
+	err = binary.Write(store.memoryBuffer, fileEncoding, uint64(len(body)))
 
 	if err != nil {
 		return 0, 0, err
 	}
 
+	//write the checksum of the bytes so reads can detect corruption
+	if store.version != storeVersionLegacy {
+		err = binary.Write(store.memoryBuffer, fileEncoding, crc32.Checksum(body, crcTable))
+
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
 	//write the bytes to the store's buffered writer
-	numberOfBytesWritten, err := store.memoryBuffer.Write(bytes)
+	numberOfBytesWritten, err := store.memoryBuffer.Write(body)
 
 	if err != nil {
 		return 0, 0, err
 	}
 
-	numberOfBytesWritten += lenWidth
+	totalBytes = uint64(numberOfBytesWritten) + store.frameWidth()
 
 	//the store size grows by the number of bytes recently appended
-	store.size += uint64(numberOfBytesWritten)
+	store.size += totalBytes
 
-	return uint64(numberOfBytesWritten), position, nil
+	store.appendedBytes += uint64(len(bytes))
+	store.encodedBytes += uint64(len(body))
+
+	return totalBytes, position, nil
 }
 
 func (store *store) Read(position uint64) ([]byte, error) {
 
-	//obtain a lock on the store before performing any actions
+	readBytes, _, err := store.readFrame(position)
+
+	return readBytes, err
+}
+
+// seek returns the position of the frame n frames after the one at position,
+// reading only the frames' lengths on the way. It stops early at limit,
+// a position no further than the end of the store, and returns io.EOF
+// when it gets to the end.
+func (store *store) seek(position uint64, n uint32, limit uint64) (uint64, error) {
+
+	if n == 0 {
+		return position, nil
+	}
+
+	size := make([]byte, lenWidth)
+
+	for ; n > 0 && position < limit; n-- {
+		if _, err := store.ReadAt(size, int64(position)); err != nil {
+			return 0, err
+		}
+
+		position += store.frameWidth() + fileEncoding.Uint64(size)
+	}
+
+	if position >= store.size {
+		return 0, io.EOF
+	}
+
+	return position, nil
+}
+
+// readFrame reads the record framed at position and returns it along with
+// the position of the frame that follows.
+func (store *store) readFrame(position uint64) ([]byte, uint64, error) {
+
+	readBytes, next, err := store.readBody(position)
+
+	if err != nil || store.version < storeVersionAttributes {
+		return readBytes, next, err
+	}
+
+	readBytes, err = store.decode(readBytes)
+
+	if decryptErr, ok := err.(ErrDecrypt); ok {
+		decryptErr.Position = position
+		return nil, 0, decryptErr
+	}
+
+	return readBytes, next, err
+}
+
+// readBody reads the bytes framed at position, as they're stored, and checks
+// them against their checksum.
+func (store *store) readBody(position uint64) ([]byte, uint64, error) {
+
+	frame := make([]byte, store.frameWidth())
+
+	if _, err := store.ReadAt(frame, int64(position)); err != nil {
+		return nil, 0, err
+	}
+
+	readBytesSize := fileEncoding.Uint64(frame)
+
+	//a length running past the end of the store can only come from a damaged frame
+	if readBytesSize > store.size-position-uint64(len(frame)) {
+		return nil, 0, api.ErrCorruptRecord{Position: position}
+	}
+
+	readBytes := make([]byte, readBytesSize)
+
+	if _, err := store.ReadAt(readBytes, int64(position)+int64(len(frame))); err != nil {
+		if err == io.EOF {
+			return nil, 0, api.ErrCorruptRecord{Position: position}
+		}
+		return nil, 0, err
+	}
+
+	if store.version != storeVersionLegacy &&
+		crc32.Checksum(readBytes, crcTable) != fileEncoding.Uint32(frame[lenWidth:]) {
+		return nil, 0, api.ErrCorruptRecord{Position: position}
+	}
+
+	next := position + uint64(len(frame)) + readBytesSize
+
+	if store.version >= storeVersionAttributes && len(readBytes) < attributesWidth {
+		return nil, 0, api.ErrCorruptRecord{Position: position}
+	}
+
+	return readBytes, next, nil
+}
+
+// batchRun scans the frames from position to the end of the store and
+// returns the position of the first of those at the end flagged as followed
+// by more of their batch, or the store's size if the last one isn't.
+func (store *store) batchRun(position uint64) (uint64, error) {
+	start := store.size
+	for position < store.size {
+		body, next, err := store.readBody(position)
+		if err != nil {
+			return 0, err
+		}
+		if body[0]&attributeBatchContinues == 0 {
+			start = store.size
+		} else if start == store.size {
+			start = position
+		}
+		position = next
+	}
+	return start, nil
+}
+
+// isTorn reports whether err, from reading the frame at position, comes
+// from a frame that was only partly written when the process died: one cut
+// short by the end of the store, with a length running past it, or the
+// store's last frame failing its checksum. A frame failing its checksum
+// before the tail is damage rather than a torn write, and the frames after
+// it are still good, so it isn't torn.
+func (store *store) isTorn(position uint64, err error) bool {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return true
+	}
+	if _, ok := err.(api.ErrCorruptRecord); !ok {
+		return false
+	}
+
+	frame := make([]byte, store.frameWidth())
+	end := position + uint64(len(frame))
+	if end > store.size {
+		return true
+	}
+	if _, err := store.ReadAt(frame, int64(position)); err != nil {
+		return false
+	}
+	return fileEncoding.Uint64(frame) >= store.size-end
+}
+
+// encode compresses p with the store's codec, encrypts it if the store has
+// keys and prefixes the result with the given attributes and those saying
+// how it was encoded. Stores written before frames carried attributes take
+// p as it is.
+func (store *store) encode(attributes uint8, p []byte) ([]byte, error) {
+	if store.version < storeVersionAttributes {
+		return p, nil
+	}
+
+	if store.codec != nil {
+		encoded, err := store.codec.Encode(p)
+		if err != nil {
+			return nil, err
+		}
+		attributes |= store.codec.ID() & codecMask
+		p = encoded
+	}
+
+	if store.keys != nil {
+		attributes |= attributeEncrypted
+		encrypted, err := store.encrypt(attributes, p)
+		if err != nil {
+			return nil, err
+		}
+		p = encrypted
+	}
+
+	body := make([]byte, attributesWidth+len(p))
+	body[0] = attributes
+	copy(body[attributesWidth:], p)
+	return body, nil
+}
+
+// decode reverses encode, looking up the codec by the ID in the attributes.
+func (store *store) decode(body []byte) ([]byte, error) {
+	id := body[0] & codecMask
+	p := body[attributesWidth:]
+
+	if body[0]&attributeEncrypted != 0 {
+		var err error
+		if p, err = store.decrypt(body[0], p); err != nil {
+			return nil, err
+		}
+	}
+
+	if id == 0 {
+		return p, nil
+	}
+
+	codec := store.codec
+	if codec == nil || codec.ID() != id {
+		var err error
+		if codec, err = codecByID(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return codec.Decode(p)
+}
+
+// firstPosition returns the position of the first frame in the store.
+func (store *store) firstPosition() uint64 {
+	if store.version == storeVersionLegacy {
+		return 0
+	}
+	return headerWidth
+}
+
+// flush writes the buffered records through to the file.
+func (store *store) flush() error {
+
 	store.mutex.Lock()
 
-	//release the lock when done reading from the store
 	defer store.mutex.Unlock()
 
-	//ensure that the store has flushed all records to disk before we can read
-	err := store.memoryBuffer.Flush()
+	return store.flushBuffer()
+}
+
+// flushBuffer writes the buffer through to the file and moves the flushed
+// watermark up to the end of the store. The caller must hold the lock.
+func (store *store) flushBuffer() error {
+
+	if err := store.memoryBuffer.Flush(); err != nil {
+		return err
+	}
+
+	atomic.StoreUint64(&store.flushed, store.size)
+	return nil
+}
+
+// flushedTo makes sure the store's bytes up to end are in the file. Only
+// reads past the flushed watermark take the lock, to flush the buffer.
+func (store *store) flushedTo(end uint64) error {
+
+	if end <= atomic.LoadUint64(&store.flushed) {
+		return nil
+	}
+
+	return store.flush()
+}
+
+// seal maps the store into memory once nothing more will be appended to
+// it, so it's read without locking or flushing.
+func (store *store) seal() error {
+
+	if err := store.flush(); err != nil {
+		return err
+	}
+
+	store.mapMutex.Lock()
+
+	defer store.mapMutex.Unlock()
+
+	if store.memoryMap != nil || store.size == 0 {
+		return nil
+	}
+
+	memoryMap, err := gommap.MapRegion(store.File.Fd(), 0, int64(store.size), gommap.PROT_READ, gommap.MAP_SHARED)
 
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	defaultSizeByteArray := make([]byte, lenWidth)
+	store.memoryMap = memoryMap
+	return nil
+}
+
+// unseal unmaps a sealed store so it can be appended to again, once the
+// readers copying from the map are done. Later reads go to the file, and
+// fail once it's closed.
+func (store *store) unseal() error {
 
-	if _, err := store.File.ReadAt(defaultSizeByteArray, int64(position)); err != nil {
-		return nil, err
+	store.mapMutex.Lock()
+
+	defer store.mapMutex.Unlock()
+
+	if store.memoryMap == nil {
+		return nil
 	}
 
-	readBytesSize := fileEncoding.Uint64(defaultSizeByteArray)
+	err := store.memoryMap.UnsafeUnmap()
+	store.memoryMap = nil
+	return err
+}
 
-	readBytes := make([]byte, readBytesSize)
+// sync flushes the buffered records and commits the file to stable storage.
+func (store *store) sync() error {
 
-	if _, err := store.File.ReadAt(readBytes, int64(position+lenWidth)); err != nil {
-		return nil, err
+	store.mutex.Lock()
+
+	defer store.mutex.Unlock()
+
+	if err := store.flushBuffer(); err != nil {
+		return err
 	}
 
-	return readBytes, nil
+	return store.File.Sync()
 }
 
-func (store *store) ReadAt(bytes []byte, offset int64) (int, error) {
+// truncate cuts the store down to size bytes.
+func (store *store) truncate(size uint64) error {
 
 	store.mutex.Lock()
 
 	defer store.mutex.Unlock()
 
-	err := store.memoryBuffer.Flush()
+	if err := store.flushBuffer(); err != nil {
+		return err
+	}
 
-	if err != nil {
+	if err := store.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+
+	store.size = size
+	atomic.StoreUint64(&store.flushed, size)
+	return nil
+}
+
+// ReadAt reads a sealed store from its memory map and the active one from
+// the file, flushing the buffer only when the read runs past what's been
+// flushed already.
+func (store *store) ReadAt(bytes []byte, offset int64) (int, error) {
+
+	store.mapMutex.RLock()
+
+	if store.memoryMap != nil {
+		defer store.mapMutex.RUnlock()
+		if offset >= int64(len(store.memoryMap)) {
+			return 0, io.EOF
+		}
+		n := copy(bytes, store.memoryMap[offset:])
+		if n < len(bytes) {
+			return n, io.EOF
+		}
+		return n, nil
+	}
+
+	store.mapMutex.RUnlock()
+
+	if err := store.flushedTo(uint64(offset) + uint64(len(bytes))); err != nil {
 		return 0, err
 	}
 
@@ -134,5 +616,9 @@ func (store *store) Close() error {
 		return err
 	}
 
+	if err = store.unseal(); err != nil {
+		return err
+	}
+
 	return store.File.Close()
 }
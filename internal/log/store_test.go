@@ -2,14 +2,17 @@ package log
 
 import (
 	"github.com/stretchr/testify/require"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"hash/crc32"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
 )
 
 var (
 	write = []byte("hello commit log")
-	width = uint64(len(write)) + lenWidth
+	width = uint64(len(write)) + lenWidth + crcWidth + attributesWidth
 )
 
 //In this test, we create a store with a temporary file and call two test helpers
@@ -23,14 +26,14 @@ func TestStoreAppendRead(t *testing.T) {
 
 	defer os.Remove(file.Name())
 
-	store, err := newStore(file)
+	store, err := newStore(file, Config{})
 	require.NoError(t, err)
 
 	testAppend(t, store)
 	testRead(t, store)
 	testRead(t, store)
 
-	store, err = newStore(file)
+	store, err = newStore(file, Config{})
 	require.NoError(t, err)
 	testRead(t, store)
 }
@@ -44,7 +47,7 @@ func testAppend(t *testing.T, store *store) {
 
 		totalBytes, position, err := store.Append(write)
 		require.NoError(t, err)
-		require.Equal(t, position+totalBytes, width*i)
+		require.Equal(t, position+totalBytes, headerWidth+width*i)
 
 	}
 }
@@ -53,7 +56,7 @@ func testRead(t *testing.T, store *store) {
 
 	t.Helper()
 
-	var readPosition uint64
+	readPosition := uint64(headerWidth)
 
 	for i := uint64(1); i < 4; i++ {
 
@@ -69,24 +72,129 @@ func testReadAt(t *testing.T, store *store) {
 
 	t.Helper()
 
-	for i, offset := uint64(1), int64(0); i < 4; i++ {
+	for i, offset := uint64(1), int64(headerWidth); i < 4; i++ {
 
-		bytes := make([]byte, lenWidth)
+		bytes := make([]byte, lenWidth+crcWidth)
 		bytesRead, err := store.ReadAt(bytes, offset)
 		require.NoError(t, err)
-		require.Equal(t, lenWidth, bytesRead)
+		require.Equal(t, lenWidth+crcWidth, bytesRead)
 		offset += int64(bytesRead)
 		size := fileEncoding.Uint64(bytes)
 
 		bytes = make([]byte, size)
 		bytesRead, err = store.ReadAt(bytes, offset)
 		require.NoError(t, err)
-		require.Equal(t, write, bytes)
+		require.Equal(t, write, bytes[attributesWidth:])
 		require.Equal(t, int(size), bytesRead)
 		offset += int64(bytesRead)
 	}
 }
 
+// A flipped bit in a record's bytes should fail the checksum and report
+// where the damaged frame starts.
+func TestStoreChecksum(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "store_checksum_test")
+	require.NoError(t, err)
+
+	defer os.Remove(file.Name())
+
+	store, err := newStore(file, Config{})
+	require.NoError(t, err)
+
+	_, position, err := store.Append(write)
+	require.NoError(t, err)
+	require.NoError(t, store.Close())
+
+	file, err = os.OpenFile(file.Name(), os.O_RDWR, 0644)
+	require.NoError(t, err)
+
+	_, err = file.WriteAt([]byte{'H'}, int64(position+lenWidth+crcWidth))
+	require.NoError(t, err)
+
+	store, err = newStore(file, Config{})
+	require.NoError(t, err)
+
+	_, err = store.Read(position)
+	require.Equal(t, api.ErrCorruptRecord{Position: position}, err)
+}
+
+// Stores written before checksums were added have no header and must stay readable.
+func TestStoreLegacy(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "store_legacy_test")
+	require.NoError(t, err)
+
+	defer os.Remove(file.Name())
+
+	for i := 0; i < 3; i++ {
+		size := make([]byte, lenWidth)
+		fileEncoding.PutUint64(size, uint64(len(write)))
+		_, err = file.Write(append(size, write...))
+		require.NoError(t, err)
+	}
+
+	store, err := newStore(file, Config{})
+	require.NoError(t, err)
+	require.Equal(t, storeVersionLegacy, store.version)
+
+	for position := uint64(0); position < store.size; position += uint64(len(write)) + lenWidth {
+		read, err := store.Read(position)
+		require.NoError(t, err)
+		require.Equal(t, write, read)
+	}
+
+	_, position, err := store.Append(write)
+	require.NoError(t, err)
+
+	read, err := store.Read(position)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+// Stores written when frames carried a checksum but no attributes must stay readable.
+func TestStoreChecksumVersion(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "store_checksum_version_test")
+	require.NoError(t, err)
+
+	defer os.Remove(file.Name())
+
+	header := make([]byte, headerWidth)
+	copy(header, storeMagic)
+	fileEncoding.PutUint32(header[len(storeMagic):], storeVersionChecksum)
+	_, err = file.Write(header)
+	require.NoError(t, err)
+
+	frame := make([]byte, lenWidth+crcWidth)
+	fileEncoding.PutUint64(frame, uint64(len(write)))
+	fileEncoding.PutUint32(frame[lenWidth:], crc32.Checksum(write, crcTable))
+	_, err = file.Write(append(frame, write...))
+	require.NoError(t, err)
+
+	store, err := newStore(file, Config{})
+	require.NoError(t, err)
+	require.Equal(t, storeVersionChecksum, store.version)
+
+	read, err := store.Read(headerWidth)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+}
+
+// Stores written in a format newer than this version knows are rejected.
+func TestStoreNewerVersion(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "store_newer_version_test")
+	require.NoError(t, err)
+
+	defer os.Remove(file.Name())
+
+	require.NoError(t, writeStoreHeader(file, storeVersion+1))
+
+	_, err = newStore(file, Config{})
+	require.Equal(t, ErrStoreVersion{Name: file.Name(), Version: storeVersion + 1}, err)
+}
+
 func TestStoreClose(t *testing.T) {
 
 	file, err := ioutil.TempFile("", "store_close_test")
@@ -94,7 +202,7 @@ func TestStoreClose(t *testing.T) {
 
 	defer os.Remove(file.Name())
 
-	store, err := newStore(file)
+	store, err := newStore(file, Config{})
 	require.NoError(t, err)
 
 	_, _, err = store.Append(write)
@@ -112,6 +220,87 @@ func TestStoreClose(t *testing.T) {
 	require.True(t, afterSize > beforeSize)
 }
 
+// Reads below the flushed watermark don't flush, and a sealed store is read
+// from its memory map.
+func TestStoreSeal(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "store_seal_test")
+	require.NoError(t, err)
+
+	defer os.Remove(file.Name())
+
+	store, err := newStore(file, Config{})
+	require.NoError(t, err)
+
+	testAppend(t, store)
+	require.Equal(t, uint64(headerWidth), store.flushed)
+
+	testRead(t, store)
+	require.Equal(t, store.size, store.flushed)
+
+	//the new record is buffered, reading the old ones leaves it there
+	_, _, err = store.Append(write)
+	require.NoError(t, err)
+	testRead(t, store)
+	require.Equal(t, store.size-width, store.flushed)
+
+	require.NoError(t, store.seal())
+	require.NotNil(t, store.memoryMap)
+	require.Equal(t, store.size, store.flushed)
+	testRead(t, store)
+	testReadAt(t, store)
+
+	//a store unsealed by a rollback is appended to again
+	require.NoError(t, store.unseal())
+	require.Nil(t, store.memoryMap)
+	_, position, err := store.Append(write)
+	require.NoError(t, err)
+	read, err := store.Read(position)
+	require.NoError(t, err)
+	require.Equal(t, write, read)
+
+	require.NoError(t, store.seal())
+	require.NoError(t, store.Close())
+	require.Nil(t, store.memoryMap)
+}
+
+// TestStoreSealedClose tests that a sealed store can be closed while it's
+// read from without holding any lock: the reads fail once it's closed,
+// rather than faulting on the unmapped memory.
+func TestStoreSealedClose(t *testing.T) {
+
+	file, err := ioutil.TempFile("", "store_sealed_close_test")
+	require.NoError(t, err)
+
+	defer os.Remove(file.Name())
+
+	store, err := newStore(file, Config{})
+	require.NoError(t, err)
+
+	testAppend(t, store)
+	require.NoError(t, store.seal())
+
+	var readers sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			p := make([]byte, width)
+			for {
+				if _, err := store.ReadAt(p, headerWidth); err != nil {
+					return
+				}
+			}
+		}()
+	}
+
+	require.NoError(t, store.Close())
+	readers.Wait()
+
+	_, err = store.ReadAt(make([]byte, width), headerWidth)
+	require.Error(t, err)
+}
+
 func openFile(name string) (file *os.File, size int64, err error) {
 
 	file, err = os.OpenFile(
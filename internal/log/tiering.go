@@ -0,0 +1,518 @@
+package log
+
+import (
+	"fmt"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BlobStore keeps the segments the log offloads, as named blobs.
+type BlobStore interface {
+	// Put stores the blob, replacing one with the same name.
+	Put(name string, r io.Reader) error
+	// Get opens the blob for reading; it returns an error satisfying
+	// os.IsNotExist if there's no such blob.
+	Get(name string) (io.ReadCloser, error)
+	// Delete removes the blob, if there is one.
+	Delete(name string) error
+	// List returns the names of all the blobs.
+	List() ([]string, error)
+}
+
+// remoteDir is the directory in the log's directory that offloaded
+// segments fetched for reads are cached in.
+const remoteDir = "remote"
+
+// segmentExts are the extensions of a segment's files, the store last.
+var segmentExts = []string{".index", ".timeindex", ".store"}
+
+// remoteSegment is a segment offloaded to the blob store.
+type remoteSegment struct {
+	baseOffset uint64
+	nextOffset uint64
+}
+
+// Offload uploads the oldest sealed segments to Tiering.Store once their
+// newest record is older than Tiering.MinAge, and removes them from local
+// disk. Reads fetch them back as they're needed. Segments are offloaded
+// oldest first, so the offloaded ones always come before the local ones.
+func (log *Log) Offload() error {
+	if err := log.writable(); err != nil {
+		return err
+	}
+	if log.Config.Tiering.Store == nil {
+		return nil
+	}
+
+	// compaction mustn't swap a segment's files while they're uploaded
+	log.compactMutex.Lock()
+	defer log.compactMutex.Unlock()
+
+	deadline := time.Now().Add(-log.Config.Tiering.MinAge)
+	for {
+		log.mutex.RLock()
+		oldest := log.segments[0]
+		sealed := len(log.segments) > 1
+		log.mutex.RUnlock()
+		if !sealed {
+			return nil
+		}
+
+		modified, err := oldest.lastModified()
+		if err != nil {
+			return err
+		}
+		if !modified.Before(deadline) {
+			return nil
+		}
+
+		if err = oldest.store.flush(); err != nil {
+			return err
+		}
+		if err = upload(log.Config.Tiering.Store, oldest); err != nil {
+			return err
+		}
+
+		event, err := log.dropOffloaded(oldest)
+		if err != nil {
+			return err
+		}
+		if event == nil {
+			return nil
+		}
+		log.emit(*event)
+	}
+}
+
+// dropOffloaded removes an uploaded segment from local disk and adds it to
+// the offloaded ones, unless it's no longer the log's oldest segment, in
+// which case its blobs are deleted again. The manifest lists it as
+// offloaded before its files are removed, so a crash in between leaves
+// local files the next setup removes, and a crash before leaves blobs it
+// doesn't list.
+func (log *Log) dropOffloaded(segment *segment) (*CleanerEvent, error) {
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+
+	if log.segments[0] != segment || len(log.segments) == 1 {
+		return nil, deleteBlobs(log.Config.Tiering.Store, segment.baseOffset)
+	}
+
+	event := &CleanerEvent{
+		Kind:       SegmentOffloaded,
+		BaseOffset: segment.baseOffset,
+		Records:    segment.nextOffset - segment.baseOffset,
+		Bytes:      segment.store.size,
+	}
+
+	log.segments = log.segments[1:]
+
+	log.remoteMutex.Lock()
+	log.remote = append(log.remote, remoteSegment{
+		baseOffset: segment.baseOffset,
+		nextOffset: log.segments[0].baseOffset,
+	})
+	log.remoteMutex.Unlock()
+
+	if err := log.removeSegments(segment); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// upload puts the segment's files in the blob store. The store goes last:
+// only segments whose store is there are listed as offloaded.
+func upload(blobs BlobStore, segment *segment) error {
+	sizes := []uint64{segment.index.size, segment.timeIndex.size, segment.store.size}
+	names := []string{segment.index.Name(), segment.timeIndex.Name(), segment.store.Name()}
+
+	for i, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		// index files are bigger than their entries until they're closed
+		err = blobs.Put(path.Base(name), io.LimitReader(file, int64(sizes[i])))
+		file.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setupRemote lists the segments offloaded to the blob store that come
+// before the local ones and clears the cache of fetched segments. They're
+// the ones the manifest lists or, for a log whose manifest predates that,
+// the ones with a store in the blob store.
+func (log *Log) setupRemote() error {
+	log.remoteMutex.Lock()
+	defer log.remoteMutex.Unlock()
+
+	log.remote, log.cache = nil, nil
+
+	if log.Config.Tiering.Store == nil || log.Config.ReadOnly {
+		return nil
+	}
+	if err := os.RemoveAll(path.Join(log.Dir, remoteDir)); err != nil {
+		return err
+	}
+
+	bases := log.manifest.Remote
+	if log.manifest.Version < manifestVersionRemote {
+		var err error
+		if bases, err = listRemote(log.Config.Tiering.Store); err != nil {
+			return err
+		}
+	}
+
+	// a segment uploaded just before a crash can still be on local disk
+	lowest := log.segments[0].baseOffset
+	for _, base := range bases {
+		if base < lowest {
+			log.remote = append(log.remote, remoteSegment{baseOffset: base})
+		}
+	}
+
+	sort.Slice(log.remote, func(i, j int) bool {
+		return log.remote[i].baseOffset < log.remote[j].baseOffset
+	})
+	for i := range log.remote {
+		if i+1 < len(log.remote) {
+			log.remote[i].nextOffset = log.remote[i+1].baseOffset
+		} else {
+			log.remote[i].nextOffset = lowest
+		}
+	}
+	return nil
+}
+
+// listRemote returns the base offsets of the segments whose store is in the
+// blob store.
+func listRemote(blobs BlobStore) ([]uint64, error) {
+	names, err := blobs.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var bases []uint64
+	for _, name := range names {
+		if path.Ext(name) != ".store" {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, ".store"), 10, 0)
+		if err == nil {
+			bases = append(bases, base)
+		}
+	}
+	return bases, nil
+}
+
+// readRemote reads the record at the offset from the offloaded segments, or
+// the first one after it. It returns io.EOF if there's none before the
+// local segments, and ErrOffsetOutOfRange if the offset comes before them.
+func (log *Log) readRemote(offset uint64) (*api.Record, error) {
+	log.remoteMutex.Lock()
+	defer log.remoteMutex.Unlock()
+
+	if len(log.remote) == 0 || offset < log.remote[0].baseOffset {
+		return nil, api.ErrOffsetOutOfRange{Offset: offset}
+	}
+
+	// fetch lets go of the lock to download, so the segments can change
+	i := sort.Search(len(log.remote), func(i int) bool {
+		return log.remote[i].nextOffset > offset
+	})
+	candidates := append([]remoteSegment(nil), log.remote[i:]...)
+	for _, remote := range candidates {
+		segment, err := log.fetch(remote)
+		if err != nil {
+			return nil, err
+		}
+		if segment == nil {
+			// truncated while it was downloaded
+			return nil, api.ErrOffsetOutOfRange{Offset: offset}
+		}
+		record, err := segment.Read(offset)
+		if err == io.EOF {
+			continue
+		}
+		return record, err
+	}
+	return nil, io.EOF
+}
+
+// fetch returns an offloaded segment from the cache, downloading it first
+// if it isn't there and evicting the least recently used segment if the
+// cache is full. It returns nil if the segment was truncated while it was
+// downloaded. The caller must hold the remote lock, which is let go of
+// during the download, so appends saving the manifest and reads of cached
+// segments don't wait for the blob store; a second read of the same
+// segment waits for the first one's download.
+func (log *Log) fetch(remote remoteSegment) (*segment, error) {
+	for {
+		for i, segment := range log.cache {
+			if segment.baseOffset == remote.baseOffset {
+				log.cache = append(append(log.cache[:i:i], log.cache[i+1:]...), segment)
+				return segment, nil
+			}
+		}
+		fetching, ok := log.fetching[remote.baseOffset]
+		if !ok {
+			break
+		}
+		log.remoteMutex.Unlock()
+		<-fetching
+		log.remoteMutex.Lock()
+	}
+
+	if log.fetching == nil {
+		log.fetching = make(map[uint64]chan struct{})
+	}
+	fetching := make(chan struct{})
+	log.fetching[remote.baseOffset] = fetching
+
+	log.remoteMutex.Unlock()
+	segment, err := log.downloadSegment(remote)
+	log.remoteMutex.Lock()
+
+	delete(log.fetching, remote.baseOffset)
+	close(fetching)
+
+	if !log.hasRemote(remote.baseOffset) {
+		if segment != nil {
+			return nil, log.evict(segment)
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(log.cache) >= log.cacheSegments() {
+		if err = log.evict(log.cache[0]); err != nil {
+			segment.Close()
+			return nil, err
+		}
+		log.cache = log.cache[1:]
+	}
+	log.cache = append(log.cache, segment)
+
+	return segment, nil
+}
+
+// downloadSegment downloads an offloaded segment's files and opens it
+// read-only.
+func (log *Log) downloadSegment(remote remoteSegment) (*segment, error) {
+	dir := path.Join(log.Dir, remoteDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	for _, ext := range segmentExts {
+		name := fmt.Sprintf("%d%s", remote.baseOffset, ext)
+		err := download(log.Config.Tiering.Store, name, path.Join(dir, name))
+		if os.IsNotExist(err) && ext != ".store" {
+			// a read-only segment does without a missing index
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	conf := log.Config
+	conf.ReadOnly = true
+	segment, err := newSegment(dir, remote.baseOffset, conf)
+	if err != nil {
+		return nil, err
+	}
+	segment.nextOffset = remote.nextOffset
+	if err = segment.store.seal(); err != nil {
+		segment.Close()
+		return nil, err
+	}
+	return segment, nil
+}
+
+// hasRemote reports whether the log still has the offloaded segment with the
+// base offset. The caller must hold the remote lock.
+func (log *Log) hasRemote(baseOffset uint64) bool {
+	for _, remote := range log.remote {
+		if remote.baseOffset == baseOffset {
+			return true
+		}
+	}
+	return false
+}
+
+// evict closes a cached segment and removes its files.
+func (log *Log) evict(segment *segment) error {
+	if err := segment.Close(); err != nil {
+		return err
+	}
+	for _, ext := range segmentExts {
+		name := path.Join(log.Dir, remoteDir, fmt.Sprintf("%d%s", segment.baseOffset, ext))
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (log *Log) cacheSegments() int {
+	if n := log.Config.Tiering.CacheSegments; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// closeRemote closes the cached segments.
+func (log *Log) closeRemote() error {
+	log.remoteMutex.Lock()
+	defer log.remoteMutex.Unlock()
+
+	for _, segment := range log.cache {
+		if err := segment.Close(); err != nil {
+			return err
+		}
+	}
+	log.cache = nil
+	return nil
+}
+
+// truncateRemote drops the offloaded segments whose offsets all come
+// before lowest, as Truncate does with local segments, and returns their
+// base offsets. Their blobs are deleted once the manifest no longer lists
+// them.
+func (log *Log) truncateRemote(lowest uint64) ([]uint64, error) {
+	log.remoteMutex.Lock()
+	defer log.remoteMutex.Unlock()
+
+	var dropped []uint64
+	for len(log.remote) > 0 && log.remote[0].nextOffset <= lowest+1 {
+		base := log.remote[0].baseOffset
+		for i, segment := range log.cache {
+			if segment.baseOffset == base {
+				if err := log.evict(segment); err != nil {
+					return dropped, err
+				}
+				log.cache = append(log.cache[:i:i], log.cache[i+1:]...)
+				break
+			}
+		}
+		dropped = append(dropped, base)
+		log.remote = log.remote[1:]
+	}
+	return dropped, nil
+}
+
+// deleteBlobs deletes the blobs of an offloaded segment. The store goes
+// first, so a segment is never listed without its indexes.
+func deleteBlobs(blobs BlobStore, baseOffset uint64) error {
+	for i := len(segmentExts) - 1; i >= 0; i-- {
+		if err := blobs.Delete(fmt.Sprintf("%d%s", baseOffset, segmentExts[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lowestOffset returns the lowest offset in the log, offloaded or not. The
+// caller must hold the lock.
+func (log *Log) lowestOffset() uint64 {
+	log.remoteMutex.Lock()
+	defer log.remoteMutex.Unlock()
+
+	if len(log.remote) > 0 {
+		return log.remote[0].baseOffset
+	}
+	return log.segments[0].baseOffset
+}
+
+// download copies a blob to a local file.
+func download(blobs BlobStore, name, file string) error {
+	r, err := blobs.Get(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	return writeFile(file, r)
+}
+
+// writeFile writes r to a new file that's renamed into place once it's
+// complete, so the file is never seen half written.
+func writeFile(name string, r io.Reader) error {
+	file, err := os.OpenFile(name+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(file, r); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// DirBlobStore keeps blobs as files in a local directory, slashes in their
+// names making subdirectories. It's mostly useful for testing, or with a
+// directory on a network file system.
+type DirBlobStore struct {
+	Dir string
+}
+
+// NewDirBlobStore returns a blob store in dir, creating the directory if
+// it doesn't exist.
+func NewDirBlobStore(dir string) (*DirBlobStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &DirBlobStore{Dir: dir}, nil
+}
+
+func (s *DirBlobStore) Put(name string, r io.Reader) error {
+	name = path.Join(s.Dir, name)
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+	return writeFile(name, r)
+}
+
+func (s *DirBlobStore) Get(name string) (io.ReadCloser, error) {
+	return os.Open(path.Join(s.Dir, name))
+}
+
+func (s *DirBlobStore) Delete(name string) error {
+	err := os.Remove(path.Join(s.Dir, name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *DirBlobStore) List() ([]string, error) {
+	var names []string
+	err := filepath.Walk(s.Dir, func(name string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || path.Ext(name) == ".tmp" {
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, name)
+		names = append(names, filepath.ToSlash(rel))
+		return err
+	})
+	return names, err
+}
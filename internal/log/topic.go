@@ -0,0 +1,134 @@
+package log
+
+import (
+	api "github.com/xhantimda/commitlog/api/v1"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// Topic is a topic hosted by a Manager, split into partitions that each
+// have their own log and their own offsets. A topic created without
+// partitions has a single one, its log.
+type Topic struct {
+	// appends counts the records appended through the topic, for
+	// partitioners that spread records evenly; it's first so atomic
+	// operations find it 64-bit aligned
+	appends uint64
+
+	Name string
+	// Partitioner picks the partition Append appends to, KeyHashPartitioner
+	// unless it's changed.
+	Partitioner Partitioner
+
+	partitions  []*Log
+	partitioned bool
+}
+
+// Partitioner picks which of a topic's partitions a record is appended to.
+type Partitioner interface {
+	// Partition returns the partition, from 0 to n-1, for the record. seq
+	// counts the records appended to the topic, so partitioners can spread
+	// records across the partitions without keeping state of their own.
+	Partition(record *api.Record, n int, seq uint64) int
+}
+
+// KeyHashPartitioner sends every record with the same key to the same
+// partition, so a key's records stay in order. Records without a key are
+// spread round-robin.
+type KeyHashPartitioner struct{}
+
+func (KeyHashPartitioner) Partition(record *api.Record, n int, seq uint64) int {
+	if len(record.Key) == 0 {
+		return RoundRobinPartitioner{}.Partition(record, n, seq)
+	}
+	hash := fnv.New32a()
+	hash.Write(record.Key)
+	return int(hash.Sum32() % uint32(n))
+}
+
+// RoundRobinPartitioner spreads records evenly across the partitions,
+// whatever their keys.
+type RoundRobinPartitioner struct{}
+
+func (RoundRobinPartitioner) Partition(_ *api.Record, n int, seq uint64) int {
+	return int(seq % uint64(n))
+}
+
+// ExplicitPartitioner appends every record to the partition it's set to.
+type ExplicitPartitioner int
+
+func (p ExplicitPartitioner) Partition(*api.Record, int, uint64) int {
+	return int(p)
+}
+
+// PartitionInfo describes a partition's range of offsets.
+type PartitionInfo struct {
+	ID int
+	// LowestOffset is the partition's first offset and NextOffset the one
+	// its next record gets; the partition is empty when they're equal.
+	LowestOffset uint64
+	NextOffset   uint64
+}
+
+// Partitions returns how many partitions the topic has.
+func (t *Topic) Partitions() int {
+	return len(t.partitions)
+}
+
+// Partitioned reports whether the topic was created with partitions.
+func (t *Topic) Partitioned() bool {
+	return t.partitioned
+}
+
+// Partition returns the log of the partition with the given ID.
+func (t *Topic) Partition(id int) (*Log, error) {
+	if id < 0 || id >= len(t.partitions) {
+		return nil, ErrUnknownPartition{Topic: t.Name, Partition: id}
+	}
+	return t.partitions[id], nil
+}
+
+// Append appends the record to the partition the topic's partitioner
+// picks, and returns the partition along with the record's offset in it.
+func (t *Topic) Append(record *api.Record) (int, uint64, error) {
+	return t.AppendWith(t.Partitioner, record)
+}
+
+// AppendWith appends the record to the partition p picks.
+func (t *Topic) AppendWith(p Partitioner, record *api.Record) (int, uint64, error) {
+	seq := atomic.AddUint64(&t.appends, 1) - 1
+	id := p.Partition(record, len(t.partitions), seq)
+
+	log, err := t.Partition(id)
+	if err != nil {
+		return 0, 0, err
+	}
+	off, err := log.Append(record)
+	return id, off, err
+}
+
+// PartitionInfo returns the offset ranges of the topic's partitions.
+func (t *Topic) PartitionInfo() []PartitionInfo {
+	infos := make([]PartitionInfo, len(t.partitions))
+	for i, log := range t.partitions {
+		log.mutex.RLock()
+		infos[i] = PartitionInfo{
+			ID:           i,
+			LowestOffset: log.lowestOffset(),
+			NextOffset:   log.activeSegment.nextOffset,
+		}
+		log.mutex.RUnlock()
+	}
+	return infos
+}
+
+// close closes the logs of the topic's partitions.
+func (t *Topic) close() error {
+	var err error
+	for _, log := range t.partitions {
+		if closeErr := log.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
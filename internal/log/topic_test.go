@@ -0,0 +1,95 @@
+package log
+
+import (
+	"github.com/stretchr/testify/require"
+	api "github.com/xhantimda/commitlog/api/v1"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestPartitionedTopic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partitioned-topic-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	m, err := NewManager(dir, Config{})
+	require.NoError(t, err)
+
+	_, err = m.CreatePartitioned("events", 0)
+	require.Error(t, err)
+
+	topic, err := m.CreatePartitioned("events", 3)
+	require.NoError(t, err)
+	require.True(t, topic.Partitioned())
+	require.Equal(t, 3, topic.Partitions())
+
+	_, err = m.Log("events")
+	require.Equal(t, ErrPartitionedTopic{Topic: "events"}, err)
+
+	// a key's records all go to one partition, in order
+	var keyed int
+	for i := uint64(0); i < 5; i++ {
+		partition, off, err := topic.Append(&api.Record{Key: []byte("user-1"), Value: []byte("hello world")})
+		require.NoError(t, err)
+		if i == 0 {
+			keyed = partition
+		}
+		require.Equal(t, keyed, partition)
+		require.Equal(t, i, off)
+	}
+
+	// round-robin spreads records over every partition
+	seen := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		partition, _, err := topic.AppendWith(RoundRobinPartitioner{}, &api.Record{Key: []byte("user-1")})
+		require.NoError(t, err)
+		seen[partition] = true
+	}
+	require.Len(t, seen, 3)
+
+	partition, _, err := topic.AppendWith(ExplicitPartitioner(2), &api.Record{Value: []byte("explicit")})
+	require.NoError(t, err)
+	require.Equal(t, 2, partition)
+	_, _, err = topic.AppendWith(ExplicitPartitioner(3), &api.Record{})
+	require.Equal(t, ErrUnknownPartition{Topic: "events", Partition: 3}, err)
+
+	infos := topic.PartitionInfo()
+	require.Len(t, infos, 3)
+	var records uint64
+	for i, info := range infos {
+		require.Equal(t, i, info.ID)
+		require.Equal(t, uint64(0), info.LowestOffset)
+		records += info.NextOffset
+	}
+	require.Equal(t, uint64(9), records)
+
+	// the partitions are found again when the topic is reopened
+	require.NoError(t, m.Close())
+	m, err = NewManager(dir, Config{})
+	require.NoError(t, err)
+	defer m.Close()
+
+	topic, err = m.Topic("events")
+	require.NoError(t, err)
+	require.Equal(t, infos, topic.PartitionInfo())
+
+	log, err := topic.Partition(2)
+	require.NoError(t, err)
+	record, err := log.Read(infos[2].NextOffset - 1)
+	require.NoError(t, err)
+	require.Equal(t, []byte("explicit"), record.Value)
+
+	// a topic created without partitions has one
+	_, err = m.Create("plain")
+	require.NoError(t, err)
+	plain, err := m.Topic("plain")
+	require.NoError(t, err)
+	require.False(t, plain.Partitioned())
+	require.Equal(t, 1, plain.Partitions())
+
+	require.NoError(t, m.Delete("events"))
+	topics, err := m.Topics()
+	require.NoError(t, err)
+	require.Equal(t, []string{"plain"}, topics)
+}
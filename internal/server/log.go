@@ -3,6 +3,7 @@ package server
 import (
 	"fmt"
 	"sync"
+	"time"
 )
 
 type Log struct {
@@ -11,8 +12,16 @@ type Log struct {
 }
 
 type Record struct {
-	Value  []byte `json:"value"`
-	Offset uint64 `json:"offset"`
+	Value     []byte   `json:"value"`
+	Offset    uint64   `json:"offset"`
+	Timestamp int64    `json:"timestamp"`
+	Key       []byte   `json:"key,omitempty"`
+	Headers   []Header `json:"headers,omitempty"`
+}
+
+type Header struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
 }
 
 func NewLog() *Log {
@@ -24,6 +33,7 @@ func (c *Log) Append(record Record) (uint64, error) {
 
 	defer c.mu.Unlock()
 	record.Offset = uint64(len(c.records))
+	record.Timestamp = time.Now().UnixMilli()
 	c.records = append(c.records, record)
 	return record.Offset, nil
 }
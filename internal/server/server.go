@@ -5,11 +5,13 @@ import (
 	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
 	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
 	api "github.com/xhantimda/commitlog/api/v1"
+	"github.com/xhantimda/commitlog/internal/log"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"time"
 )
 
 const (
@@ -52,12 +54,43 @@ func (srv *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*a
 		return nil, err
 	}
 
-	offset, err := srv.CommitLog.Append(req.Record)
+	if req.Topic == "" {
+		clog, err := srv.commitLog("", 0)
+		if err != nil {
+			return nil, err
+		}
+		offset, err := clog.Append(req.Record)
+		if err != nil {
+			return nil, err
+		}
+		return &api.ProduceResponse{Offset: offset}, nil
+	}
+
+	topic, err := srv.topic(req.Topic, true)
 	if err != nil {
 		return nil, err
 	}
 
-	return &api.ProduceResponse{Offset: offset}, nil
+	var partitioner log.Partitioner
+	switch req.Partitioning {
+	case api.Partitioning_PARTITIONING_DEFAULT:
+		partitioner = topic.Partitioner
+	case api.Partitioning_PARTITIONING_KEY_HASH:
+		partitioner = log.KeyHashPartitioner{}
+	case api.Partitioning_PARTITIONING_ROUND_ROBIN:
+		partitioner = log.RoundRobinPartitioner{}
+	case api.Partitioning_PARTITIONING_EXPLICIT:
+		partitioner = log.ExplicitPartitioner(req.Partition)
+	default:
+		return nil, status.Errorf(codes.InvalidArgument, "unknown partitioning %d", req.Partitioning)
+	}
+
+	partition, offset, err := topic.AppendWith(partitioner, req.Record)
+	if err != nil {
+		return nil, topicError(err)
+	}
+
+	return &api.ProduceResponse{Offset: offset, Partition: uint32(partition)}, nil
 }
 
 func (srv *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
@@ -65,7 +98,19 @@ func (srv *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*a
 		return nil, err
 	}
 
-	record, err := srv.CommitLog.Read(req.Offset)
+	clog, err := srv.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return nil, err
+	}
+
+	offset := req.Offset
+	if req.StartTime != 0 {
+		if offset, err = clog.OffsetForTime(time.UnixMilli(req.StartTime)); err != nil {
+			return nil, err
+		}
+	}
+
+	record, err := clog.Read(offset)
 	if err != nil {
 		return nil, err
 	}
@@ -98,30 +143,121 @@ func (srv *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 // so the client can tell the server where in the log to read records,
 // and then the server will stream every record that follows.
 func (srv *grpcServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
-	for {
-		select {
-		case <-stream.Context().Done():
+	ctx := stream.Context()
+	if err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return err
+	}
+
+	clog, err := srv.commitLog(req.Topic, req.Partition)
+	if err != nil {
+		return err
+	}
+
+	// resolve a start time once, the stream then moves on by offset
+	offset := req.Offset
+	if req.StartTime != 0 {
+		if offset, err = clog.OffsetForTime(time.UnixMilli(req.StartTime)); err != nil {
+			return err
+		}
+	}
+
+	it := clog.NewIterator(offset).Follow(ctx)
+	for it.Next() {
+		if err := stream.Send(&api.ConsumeResponse{Record: it.Record()}); err != nil {
+			return err
+		}
+	}
+
+	switch err := it.Err().(type) {
+	case log.ErrTruncated:
+		return api.ErrOffsetOutOfRange{Offset: err.Offset}
+	default:
+		// the client going away ends the stream
+		if ctx.Err() != nil {
 			return nil
-		default:
-			res, err := srv.Consume(stream.Context(), req)
-			if err != nil {
-				return err
-			}
-
-			switch err.(type) {
-			case nil:
-			case api.ErrOffsetOutOfRange:
-				continue
-			default:
-				return err
-			}
-
-			if err = stream.Send(res); err != nil {
-				return err
-			}
-
-			req.Offset++
 		}
+		return err
+	}
+}
+
+// ListPartitions returns the partitions of a topic and their offset
+// ranges; a topic created without partitions has one.
+func (srv *grpcServer) ListPartitions(ctx context.Context, req *api.ListPartitionsRequest) (*api.ListPartitionsResponse, error) {
+	if err := srv.Authorizer.Authorize(subject(ctx), objectWildcard, consumeAction); err != nil {
+		return nil, err
+	}
+
+	topic, err := srv.topic(req.Topic, false)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &api.ListPartitionsResponse{}
+	for _, info := range topic.PartitionInfo() {
+		res.Partitions = append(res.Partitions, &api.Partition{
+			Id:           uint32(info.ID),
+			LowestOffset: info.LowestOffset,
+			NextOffset:   info.NextOffset,
+		})
+	}
+	return res, nil
+}
+
+// commitLog returns the log of the partition of a request's topic, or
+// CommitLog for a request without a topic.
+func (srv *grpcServer) commitLog(topic string, partition uint32) (CommitLog, error) {
+	if topic == "" {
+		if srv.CommitLog == nil {
+			return nil, status.Error(codes.InvalidArgument, "no topic given")
+		}
+		if partition != 0 {
+			return nil, status.Error(codes.InvalidArgument, "the default log has no partitions")
+		}
+		return srv.CommitLog, nil
+	}
+
+	t, err := srv.topic(topic, false)
+	if err != nil {
+		return nil, err
+	}
+	clog, err := t.Partition(int(partition))
+	if err != nil {
+		return nil, topicError(err)
+	}
+	return clog, nil
+}
+
+// topic returns the topic with the given name. Producing to a topic that
+// doesn't exist creates it, without partitions.
+func (srv *grpcServer) topic(name string, create bool) (*log.Topic, error) {
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "no topic given")
+	}
+	if srv.Topics == nil {
+		return nil, status.Error(codes.InvalidArgument, "topics aren't enabled on this server")
+	}
+
+	topic, err := srv.Topics.Topic(name)
+	if _, ok := err.(log.ErrUnknownTopic); ok && create {
+		if _, err = srv.Topics.Log(name); err == nil {
+			topic, err = srv.Topics.Topic(name)
+		}
+	}
+	if err != nil {
+		return nil, topicError(err)
+	}
+	return topic, nil
+}
+
+// topicError gives the errors about topics and partitions their status codes.
+func topicError(err error) error {
+	switch err.(type) {
+	case log.ErrUnknownTopic, log.ErrUnknownPartition:
+		return status.Error(codes.NotFound, err.Error())
+	case log.ErrInvalidTopic:
+		return status.Error(codes.InvalidArgument, err.Error())
+	default:
+		return err
 	}
 }
 
@@ -150,7 +286,10 @@ func subject(ctx context.Context) string {
 type subjectContextKey struct{}
 
 type Config struct {
-	CommitLog  CommitLog
+	// CommitLog serves the requests that don't name a topic.
+	CommitLog CommitLog
+	// Topics, when set, serves the requests that do.
+	Topics     Topics
 	Authorizer Authorizer
 }
 
@@ -162,6 +301,17 @@ type grpcServer struct {
 type CommitLog interface {
 	Append(*api.Record) (uint64, error)
 	Read(uint64) (*api.Record, error)
+	OffsetForTime(time.Time) (uint64, error)
+	NewIterator(uint64) *log.Iterator
+}
+
+// Topics hosts topics split into partitions, like log.Manager.
+type Topics interface {
+	// Log returns the topic's log, creating the topic without partitions
+	// if it doesn't exist.
+	Log(topic string) (*log.Log, error)
+	// Topic returns the topic, or log.ErrUnknownTopic.
+	Topic(topic string) (*log.Topic, error)
 }
 
 type Authorizer interface {
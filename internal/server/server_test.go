@@ -13,7 +13,10 @@ import (
 	"google.golang.org/grpc/status"
 	"io/ioutil"
 	"net"
+	"os"
+	"path"
 	"testing"
+	"time"
 )
 
 // TestServer defines our list of test cases and then runs a subtest for each case.
@@ -28,6 +31,8 @@ func TestServer(t *testing.T) {
 		"produce/consume stream succeeds":                    testProduceConsumeStream,
 		"consume past log boundary fails":                    testConsumePastBoundary,
 		"unauthorized fails":                                 testUnauthorized,
+		"consume corrupt record fails":                       testConsumeCorrupt,
+		"consume from a start time succeeds":                 testConsumeStartTime,
 	} {
 		t.Run(tc, func(t *testing.T) {
 			rootClient, nobodyClient, conf, teardown := setupTest(t, nil)
@@ -121,6 +126,81 @@ func setupTest(t *testing.T, fn func(*Config)) (
 	}
 }
 
+// TestServerTopics tests that requests naming a topic are routed to the
+// topic's log, and requests without one to the default log.
+func TestServerTopics(t *testing.T) {
+	dir, err := ioutil.TempDir("", "server-topics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	topics, err := log.NewManager(dir, log.Config{})
+	require.NoError(t, err)
+	defer topics.Close()
+
+	client, _, _, teardown := setupTest(t, func(config *Config) {
+		config.Topics = topics
+	})
+	defer teardown()
+
+	ctx := context.Background()
+	for _, topic := range []string{"orders", "payments", ""} {
+		for i := uint64(0); i < 2; i++ {
+			produce, err := client.Produce(ctx, &api.ProduceRequest{
+				Record: &api.Record{Value: []byte("to " + topic)},
+				Topic:  topic,
+			})
+			require.NoError(t, err)
+			require.Equal(t, i, produce.Offset)
+		}
+	}
+
+	for _, topic := range []string{"orders", "payments", ""} {
+		consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 1, Topic: topic})
+		require.NoError(t, err)
+		require.Equal(t, []byte("to "+topic), consume.Record.Value)
+
+		stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Topic: topic})
+		require.NoError(t, err)
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte("to "+topic), res.Record.Value)
+	}
+
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "unknown"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+
+	// records go to the partition the request picks, with offsets per partition
+	_, err = topics.CreatePartitioned("events", 2)
+	require.NoError(t, err)
+	for _, partition := range []uint32{1, 1, 0} {
+		produce, err := client.Produce(ctx, &api.ProduceRequest{
+			Record:       &api.Record{Value: []byte("event")},
+			Topic:        "events",
+			Partitioning: api.Partitioning_PARTITIONING_EXPLICIT,
+			Partition:    partition,
+		})
+		require.NoError(t, err)
+		require.Equal(t, partition, produce.Partition)
+	}
+
+	partitions, err := client.ListPartitions(ctx, &api.ListPartitionsRequest{Topic: "events"})
+	require.NoError(t, err)
+	require.Len(t, partitions.Partitions, 2)
+	require.Equal(t, uint64(1), partitions.Partitions[0].NextOffset)
+	require.Equal(t, uint64(2), partitions.Partitions[1].NextOffset)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Topic: "events", Partition: 1, Offset: 1})
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), consume.Record.Offset)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Topic: "events", Partition: 2})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	_, err = client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+		Topic:  "../escape",
+	})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
 // testProduceConsume tests that producing and consuming
 // works by using our client and server to produce a record to the log,
 func testProduceConsume(t *testing.T, client api.LogClient, _ api.LogClient, config *Config) {
@@ -128,6 +208,10 @@ func testProduceConsume(t *testing.T, client api.LogClient, _ api.LogClient, con
 
 	want := &api.Record{
 		Value: []byte("hello world"),
+		Key:   []byte("greeting"),
+		Headers: []*api.Header{
+			{Key: "content-type", Value: []byte("text/plain")},
+		},
 	}
 	produce, err := client.Produce(
 		ctx,
@@ -142,6 +226,10 @@ func testProduceConsume(t *testing.T, client api.LogClient, _ api.LogClient, con
 	require.NoError(t, err)
 	require.Equal(t, want.Value, consume.Record.Value)
 	require.Equal(t, want.Offset, consume.Record.Offset)
+	require.Equal(t, want.Key, consume.Record.Key)
+	require.Len(t, consume.Record.Headers, 1)
+	require.Equal(t, want.Headers[0].Key, consume.Record.Headers[0].Key)
+	require.Equal(t, want.Headers[0].Value, consume.Record.Headers[0].Value)
 }
 
 // testConsumePastBoundary tests that our server responds
@@ -218,10 +306,9 @@ func testProduceConsumeStream(
 		for i, record := range records {
 			res, err := stream.Recv()
 			require.NoError(t, err)
-			require.Equal(t, res.Record, &api.Record{
-				Value:  record.Value,
-				Offset: uint64(i),
-			})
+			require.Equal(t, record.Value, res.Record.Value)
+			require.Equal(t, uint64(i), res.Record.Offset)
+			require.NotZero(t, res.Record.Timestamp)
 		}
 	}
 }
@@ -263,3 +350,77 @@ func testUnauthorized(
 		t.Fatalf("got code: %d, want: %d", gotCode, wantCode)
 	}
 }
+
+// testConsumeCorrupt tests that a record failing its checksum reaches
+// the client as a data loss error rather than a bogus record.
+func testConsumeCorrupt(
+	t *testing.T,
+	client api.LogClient,
+	_ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{
+			Value: []byte("hello world"),
+		},
+	})
+	require.NoError(t, err)
+
+	// consuming once flushes the record to disk so it can be damaged
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.NoError(t, err)
+
+	clog := config.CommitLog.(*log.Log)
+	f, err := os.OpenFile(path.Join(clog.Dir, "0.store"), os.O_RDWR, 0644)
+	require.NoError(t, err)
+	// skip the 8 byte store header, 8 byte length and 4 byte checksum
+	_, err = f.WriteAt([]byte{0xff}, 20)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{Offset: produce.Offset})
+	require.Nil(t, consume)
+	require.Equal(t, codes.DataLoss, status.Code(err))
+}
+
+// testConsumeStartTime tests that consumers can start from the first record
+// appended at or after a time instead of an offset.
+func testConsumeStartTime(
+	t *testing.T,
+	client api.LogClient,
+	_ api.LogClient,
+	config *Config,
+) {
+	ctx := context.Background()
+	produce := func(value string) uint64 {
+		res, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte(value)},
+		})
+		require.NoError(t, err)
+		return res.Offset
+	}
+
+	produce("before")
+	time.Sleep(5 * time.Millisecond)
+	start := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	want := produce("after")
+	produce("later")
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		StartTime: start.UnixMilli(),
+	})
+	require.NoError(t, err)
+	require.Equal(t, want, consume.Record.Offset)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{
+		StartTime: start.UnixMilli(),
+	})
+	require.NoError(t, err)
+	for _, value := range []string{"after", "later"} {
+		res, err := stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, []byte(value), res.Record.Value)
+	}
+}